@@ -4,29 +4,126 @@ import (
 	"time"
 )
 
-func (op *OmniPaxos) applymsg(applyCh chan ApplyMsg, currIdx int) {
-	if op.killed() {
+// A single applier goroutine delivers decided entries on applyCh in log
+// order. It sleeps on applyCond until decidedIdx advances (or a snapshot
+// is installed), and sends everything decided since it last woke up.
+
+// ApplyStats summarizes how long decided entries waited before they were
+// sent on applyCh, measured from the moment this server learned they
+// were decided.
+type ApplyStats struct {
+	Entries int
+	Mean    time.Duration
+	Max     time.Duration
+}
+
+// decideMark records when decidedIdx advanced to idx
+type decideMark struct {
+	idx int
+	at  time.Time
+}
+
+// setDecided advances decidedIdx to idx and wakes the applier, and any
+// ReadIndex waiting for it. Proposals that were waiting for it complete.
+// Must hold op.mu.
+func (op *OmniPaxos) setDecided(idx int) {
+	if idx <= op.decidedIdx {
 		return
 	}
+	op.decidedIdx = idx
+	op.decideMarks = append(op.decideMarks, decideMark{idx, time.Now()})
+	op.applyCond.Broadcast()
+	op.resolveProposals()
+}
+
+// ApplyStats returns the apply latency of the entries applied so far
+func (op *OmniPaxos) ApplyStats() ApplyStats {
 	op.mu.Lock()
-	logLen := len(op.log)
-	decidedIdx := op.decidedIdx
-	op.mu.Unlock()
+	defer op.mu.Unlock()
 
-	if currIdx < decidedIdx && currIdx < logLen {
-		op.mu.Lock()
-		applyMsg := ApplyMsg{
-			true,
-			op.log[currIdx],
-			currIdx,
+	stats := ApplyStats{Entries: op.applyCount, Max: op.applyMax}
+	if op.applyCount > 0 {
+		stats.Mean = op.applyTotal / time.Duration(op.applyCount)
+	}
+	return stats
+}
+
+func (op *OmniPaxos) applier(applyCh chan ApplyMsg) {
+	currIdx := 0
+	op.mu.Lock()
+	for !op.killed() {
+		if currIdx < op.compactedIdx {
+			// the entries we were about to apply were replaced by a snapshot,
+			// either before a restart or by catching up from the leader
+			applyMsg := ApplyMsg{
+				SnapshotValid: true,
+				Snapshot:      op.persister.ReadSnapshot(),
+				SnapshotIndex: op.compactedIdx - 1,
+			}
+			currIdx = op.compactedIdx
+			op.appliedIdx = currIdx
+			op.sessions = copySessions(op.snapSessions)
+			op.mu.Unlock()
+			applyCh <- applyMsg
+			op.mu.Lock()
+			continue
 		}
+
+		end := min(op.decidedIdx, op.logLen())
+		if op.config.ApplyBatchSize > 0 {
+			end = min(end, currIdx+op.config.ApplyBatchSize)
+		}
+		if currIdx >= end {
+			op.applyCond.Wait()
+			continue
+		}
+
+		msgs := make([]ApplyMsg, 0, end-currIdx)
+		for ; currIdx < end; currIdx++ {
+			applyMsg := ApplyMsg{
+				CommandValid: true,
+				Command:      op.log[currIdx-op.compactedIdx],
+				CommandIndex: currIdx,
+			}
+			if ss, ok := applyMsg.Command.(StopSign); ok {
+				applyMsg = ApplyMsg{CommandIndex: currIdx, StopSignValid: true, StopSign: ss}
+			} else if !applySession(op.sessions, applyMsg.Command) || isCleaned(applyMsg.Command) {
+				applyMsg = ApplyMsg{CommandIndex: currIdx}
+			}
+			msgs = append(msgs, applyMsg)
+		}
+		op.appliedIdx = currIdx
 		op.mu.Unlock()
-		applyCh <- applyMsg
-		go op.applymsg(applyCh, currIdx+1)
 
-	} else {
-		time.Sleep(op.delay)
-		go op.applymsg(applyCh, currIdx)
+		for _, applyMsg := range msgs {
+			if op.killed() {
+				return
+			}
+			applyCh <- applyMsg
+		}
+
+		op.mu.Lock()
+		op.recordApplied(currIdx)
 	}
+	op.mu.Unlock()
+}
 
+// recordApplied adds the entries before idx to the apply latency stats.
+// Must hold op.mu.
+func (op *OmniPaxos) recordApplied(idx int) {
+	now := time.Now()
+	for len(op.decideMarks) > 0 && op.decideMarks[0].idx <= idx {
+		mark := op.decideMarks[0]
+		op.decideMarks = op.decideMarks[1:]
+		// entries are counted from the mark that decided them
+		n := mark.idx - max(op.appliedMark, op.compactedIdx)
+		op.appliedMark = mark.idx
+		if n <= 0 {
+			continue
+		}
+		latency := now.Sub(mark.at)
+		op.applyCount += n
+		op.applyTotal += time.Duration(n) * latency
+		op.applyMax = max(op.applyMax, latency)
+	}
 }
@@ -0,0 +1,133 @@
+// Command omnipaxosctl sends a request to the client API of omnipaxosd and
+// prints the response.
+//
+//	omnipaxosctl [-addr host:port] propose [-server N] [-wait] COMMAND
+//	omnipaxosctl [-addr host:port] status
+//	omnipaxosctl [-addr host:port] leader
+//	omnipaxosctl [-addr host:port] log SERVER [FROM [TO]]
+//	omnipaxosctl [-addr host:port] partition 0,1 2
+//	omnipaxosctl [-addr host:port] heal
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: omnipaxosctl [-addr host:port] COMMAND [ARGS]
+
+commands:
+  propose [-server N] [-wait] COMMAND   propose COMMAND, at server N if given
+  status                                show every server
+  leader                                show the leader
+  log SERVER [FROM [TO]]                show the commands SERVER applied
+  partition GROUP...                    split the servers into groups, e.g. 0,1 2
+  heal                                  reconnect everyone
+`)
+	os.Exit(2)
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:7070", "address of omnipaxosd's client API")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	req, err := request(flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "omnipaxosctl: %v\n", err)
+		os.Exit(2)
+	}
+	res, err := send(*addr, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "omnipaxosctl: %v\n", err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(res, "", "  ")
+	fmt.Println(string(out))
+	if ok, _ := res["ok"].(bool); !ok {
+		os.Exit(1)
+	}
+}
+
+// request builds the API request for a command line
+func request(op string, args []string) (map[string]any, error) {
+	req := map[string]any{"op": op}
+	switch op {
+	case "propose":
+		fs := flag.NewFlagSet("propose", flag.ExitOnError)
+		server := fs.Int("server", -1, "server to propose at")
+		wait := fs.Bool("wait", false, "wait until the command is applied")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return nil, fmt.Errorf("propose takes one command")
+		}
+		req["command"] = fs.Arg(0)
+		if *server >= 0 {
+			req["server"] = *server
+		}
+		req["wait"] = *wait
+	case "status", "leader", "heal":
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%v takes no arguments", op)
+		}
+	case "log":
+		if len(args) < 1 || len(args) > 3 {
+			return nil, fmt.Errorf("log takes SERVER [FROM [TO]]")
+		}
+		for i, name := range []string{"server", "from", "to"}[:len(args)] {
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return nil, fmt.Errorf("log: bad %v %q", name, args[i])
+			}
+			req[name] = n
+		}
+	case "partition":
+		groups := [][]int{}
+		for _, arg := range args {
+			group := []int{}
+			for _, s := range strings.Split(arg, ",") {
+				server, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("partition: bad server %q", s)
+				}
+				group = append(group, server)
+			}
+			groups = append(groups, group)
+		}
+		req["groups"] = groups
+	default:
+		return nil, fmt.Errorf("unknown command %q", op)
+	}
+	return req, nil
+}
+
+func send(addr string, req map[string]any) (map[string]any, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]any{}
+	if err := json.Unmarshal(line, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The client API: one JSON request per line, answered by one JSON
+// response per line on the same connection.
+//
+//	{"op": "propose", "command": "x"}               propose at the leader, or at "server"; "wait" until applied
+//	{"op": "status"}                                every server's ballot, role, partition and last applied index
+//	{"op": "leader"}                                the leader with the highest ballot
+//	{"op": "log", "server": 0, "from": 0, "to": 10} the commands server applied in [from, to)
+//	{"op": "partition", "groups": [[0, 1], [2]]}    servers talk only within their group
+//	{"op": "heal"}                                  everyone talks to everyone again
+
+type Request struct {
+	Op      string  `json:"op"`
+	Command string  `json:"command,omitempty"`
+	Server  *int    `json:"server,omitempty"`
+	Wait    bool    `json:"wait,omitempty"`
+	From    int     `json:"from,omitempty"`
+	To      *int    `json:"to,omitempty"`
+	Groups  [][]int `json:"groups,omitempty"`
+}
+
+type ServerStatus struct {
+	Server      int  `json:"server"`
+	Ballot      int  `json:"ballot"`
+	Leader      bool `json:"leader"`
+	Partition   int  `json:"partition"`
+	LastApplied int  `json:"last_applied"`
+}
+
+type Response struct {
+	Ok      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Server  *int           `json:"server,omitempty"`
+	Index   *int           `json:"index,omitempty"`
+	Ballot  *int           `json:"ballot,omitempty"`
+	Applied *bool          `json:"applied,omitempty"`
+	Servers []ServerStatus `json:"servers,omitempty"`
+	Entries []Entry        `json:"entries,omitempty"`
+}
+
+// how long a propose with "wait" waits for the command to be applied
+const proposeWait = 5 * time.Second
+
+func ref[T any](v T) *T {
+	return &v
+}
+
+func fail(format string, a ...any) Response {
+	return Response{Error: fmt.Sprintf(format, a...)}
+}
+
+func (c *cluster) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Error().Msgf("accept: %v", err)
+			return
+		}
+		go c.serveConn(conn)
+	}
+}
+
+func (c *cluster) serveConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		req := Request{}
+		var res Response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			res = fail("bad request: %v", err)
+		} else {
+			res = c.handle(&req)
+		}
+		if err := enc.Encode(res); err != nil {
+			return
+		}
+	}
+}
+
+func (c *cluster) handle(req *Request) Response {
+	if req.Server != nil && (*req.Server < 0 || *req.Server >= c.n) {
+		return fail("no server %v", *req.Server)
+	}
+	switch req.Op {
+	case "propose":
+		return c.propose(req)
+	case "status":
+		return Response{Ok: true, Servers: c.status()}
+	case "leader":
+		leader := -1
+		ballot := -1
+		for _, s := range c.status() {
+			if s.Leader && s.Ballot > ballot {
+				leader, ballot = s.Server, s.Ballot
+			}
+		}
+		if leader < 0 {
+			return fail("no leader")
+		}
+		return Response{Ok: true, Server: &leader, Ballot: &ballot}
+	case "log":
+		if req.Server == nil {
+			return fail("log needs a server")
+		}
+		to := c.lastApplied(*req.Server) + 1
+		if req.To != nil {
+			to = *req.To
+		}
+		return Response{Ok: true, Server: req.Server, Entries: c.log(*req.Server, req.From, to)}
+	case "partition":
+		if err := c.partition(req.Groups); err != nil {
+			return fail("%v", err)
+		}
+		return Response{Ok: true}
+	case "heal":
+		c.heal()
+		return Response{Ok: true}
+	}
+	return fail("unknown op %q", req.Op)
+}
+
+func (c *cluster) status() []ServerStatus {
+	servers := make([]ServerStatus, c.n)
+	for i, op := range c.paxos {
+		ballot, leader := op.GetState()
+		servers[i] = ServerStatus{Server: i, Ballot: ballot, Leader: leader, LastApplied: c.lastApplied(i)}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range servers {
+		servers[i].Partition = c.group[i]
+	}
+	return servers
+}
+
+// propose proposes the command at the requested server, or at whichever
+// server takes it
+func (c *cluster) propose(req *Request) Response {
+	servers := seq(c.n)
+	if req.Server != nil {
+		servers = []int{*req.Server}
+	}
+	for _, server := range servers {
+		index, ballot, ok := c.paxos[server].Proposal(req.Command)
+		if !ok {
+			continue
+		}
+		res := Response{Ok: true, Server: ref(server), Index: ref(index), Ballot: ref(ballot)}
+		if req.Wait {
+			res.Applied = ref(c.waitApplied(server, index, req.Command))
+		}
+		return res
+	}
+	return fail("no server took the proposal")
+}
+
+// waitApplied waits for server to apply command at index
+func (c *cluster) waitApplied(server int, index int, command string) bool {
+	for t0 := time.Now(); time.Since(t0) < proposeWait; time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		cmd, ok := c.applied[server][index]
+		c.mu.Unlock()
+		if ok {
+			return cmd == command
+		}
+	}
+	return false
+}
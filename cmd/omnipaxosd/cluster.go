@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"omnipaxos"
+	"omnipaxos/labrpc"
+)
+
+// ClusterFile describes the cluster omnipaxosd runs, and the faults of
+// the labrpc network between its servers
+type ClusterFile struct {
+	Servers int    `json:"servers"`
+	Listen  string `json:"listen"` // address of the client API
+
+	Unreliable     bool        `json:"unreliable"`      // delay and drop messages
+	LongDelays     bool        `json:"long_delays"`     // messages to a cut-off server take long to fail
+	LongReordering bool        `json:"long_reordering"` // delay some replies a long time
+	LatencyMs      map[int]int `json:"latency_ms"`      // extra delay on messages to a server
+
+	HeartbeatMs int  `json:"heartbeat_ms"` // 0 for the default
+	Forwarding  bool `json:"forwarding"`   // followers forward proposals to the leader
+}
+
+func readClusterFile(path string) (*ClusterFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ClusterFile{Listen: "127.0.0.1:7070"}
+	if err := json.Unmarshal(data, cf); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if cf.Servers < 1 {
+		return nil, fmt.Errorf("%v: need at least one server, got %v", path, cf.Servers)
+	}
+	for server := range cf.LatencyMs {
+		if server < 0 || server >= cf.Servers {
+			return nil, fmt.Errorf("%v: latency for server %v, which is not in the cluster", path, server)
+		}
+	}
+	return cf, nil
+}
+
+// Entry is a command a server applied
+type Entry struct {
+	Index   int `json:"index"`
+	Command any `json:"command"`
+}
+
+// cluster is the servers of a ClusterFile on a labrpc network
+type cluster struct {
+	mu      sync.Mutex
+	net     *labrpc.Network
+	n       int
+	paxos   []*omnipaxos.OmniPaxos
+	applied []map[int]any // commands applied by each server, by index
+	group   []int         // partition each server is in
+}
+
+func endname(from int, to int) string {
+	return fmt.Sprintf("%v-%v", from, to)
+}
+
+func startCluster(cf *ClusterFile) (*cluster, error) {
+	c := &cluster{
+		net:     labrpc.MakeNetwork(),
+		n:       cf.Servers,
+		paxos:   make([]*omnipaxos.OmniPaxos, cf.Servers),
+		applied: make([]map[int]any, cf.Servers),
+		group:   make([]int, cf.Servers),
+	}
+	c.net.Reliable(!cf.Unreliable)
+	c.net.LongDelays(cf.LongDelays)
+	c.net.LongReordering(cf.LongReordering)
+	for server, ms := range cf.LatencyMs {
+		c.net.Latency(server, time.Duration(ms)*time.Millisecond)
+	}
+
+	config := omnipaxos.DefaultConfig()
+	if cf.HeartbeatMs > 0 {
+		config.HeartbeatPeriod = time.Duration(cf.HeartbeatMs) * time.Millisecond
+		config.MaxHeartbeatTimeout = max(config.MaxHeartbeatTimeout, config.HeartbeatPeriod)
+	}
+
+	for i := range c.n {
+		ends := make([]*labrpc.ClientEnd, c.n)
+		for j := range c.n {
+			ends[j] = c.net.MakeEnd(endname(i, j))
+			c.net.Connect(endname(i, j), j)
+			c.net.Enable(endname(i, j), true)
+		}
+		c.applied[i] = make(map[int]any)
+		applyCh := make(chan omnipaxos.ApplyMsg)
+		op, err := omnipaxos.MakeWithConfig(ends, i, omnipaxos.MakePersister(), applyCh, config)
+		if err != nil {
+			return nil, err
+		}
+		op.SetForwarding(cf.Forwarding)
+		c.paxos[i] = op
+		go c.apply(i, applyCh)
+
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(op))
+		c.net.AddServer(i, srv)
+	}
+	return c, nil
+}
+
+func (c *cluster) apply(server int, applyCh chan omnipaxos.ApplyMsg) {
+	for m := range applyCh {
+		if !m.CommandValid {
+			continue
+		}
+		c.mu.Lock()
+		c.applied[server][m.CommandIndex] = m.Command
+		c.mu.Unlock()
+	}
+}
+
+func (c *cluster) stop() {
+	for _, op := range c.paxos {
+		op.Kill()
+	}
+	c.net.Cleanup()
+}
+
+// partition lets servers talk only within their group. Servers not in
+// any group are cut off from everyone.
+func (c *cluster) partition(groups [][]int) error {
+	group := make([]int, c.n)
+	for i := range group {
+		group[i] = -1 - i
+	}
+	for g, servers := range groups {
+		for _, server := range servers {
+			if server < 0 || server >= c.n {
+				return fmt.Errorf("no server %v", server)
+			}
+			group[server] = g
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.group = group
+	for i := range c.n {
+		for j := range c.n {
+			c.net.Enable(endname(i, j), group[i] == group[j])
+		}
+	}
+	return nil
+}
+
+func (c *cluster) heal() {
+	c.partition([][]int{seq(c.n)})
+}
+
+func seq(n int) []int {
+	servers := make([]int, n)
+	for i := range servers {
+		servers[i] = i
+	}
+	return servers
+}
+
+// log returns the commands server applied at indices from to to,
+// excluding to
+func (c *cluster) log(server int, from int, to int) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := []Entry{}
+	for index, cmd := range c.applied[server] {
+		if index >= from && index < to {
+			entries = append(entries, Entry{index, cmd})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+	return entries
+}
+
+// lastApplied returns the highest index server applied, or -1
+func (c *cluster) lastApplied(server int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last := -1
+	for index := range c.applied[server] {
+		last = max(last, index)
+	}
+	return last
+}
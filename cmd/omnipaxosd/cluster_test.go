@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadClusterFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		err     string // part of the error, or "" for none
+		servers int
+		listen  string
+	}{
+		{"example", `{"servers": 3, "listen": "127.0.0.1:7171", "latency_ms": {"2": 50}}`, "", 3, "127.0.0.1:7171"},
+		{"default listen", `{"servers": 1}`, "", 1, "127.0.0.1:7070"},
+		{"bad json", `{"servers": 3`, "unexpected end of JSON input", 0, ""},
+		{"wrong type", `{"servers": "three"}`, "cannot unmarshal", 0, ""},
+		{"no servers", `{}`, "need at least one server", 0, ""},
+		{"negative servers", `{"servers": -1}`, "need at least one server", 0, ""},
+		{"latency past the cluster", `{"servers": 3, "latency_ms": {"3": 10}}`, "latency for server 3", 0, ""},
+		{"negative latency server", `{"servers": 3, "latency_ms": {"-1": 10}}`, "latency for server -1", 0, ""},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".json")
+		if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cf, err := readClusterFile(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%v (%v): got error %v, expected one containing %q", i, tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v (%v): %v", i, tt.name, err)
+		}
+		if cf.Servers != tt.servers || cf.Listen != tt.listen {
+			t.Fatalf("%v (%v): got %v servers listening on %v, expected %v on %v",
+				i, tt.name, cf.Servers, cf.Listen, tt.servers, tt.listen)
+		}
+	}
+
+	if _, err := readClusterFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatalf("reading a missing cluster file succeeded")
+	}
+	if _, err := readClusterFile("cluster.json"); err != nil {
+		t.Fatalf("the example cluster.json is invalid: %v", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	c, err := startCluster(&ClusterFile{Servers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.stop()
+
+	leader := -1
+	for t0 := time.Now(); leader < 0; time.Sleep(50 * time.Millisecond) {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("no leader elected")
+		}
+		if res := c.handle(&Request{Op: "leader"}); res.Ok {
+			leader = *res.Server
+		}
+	}
+
+	tests := []struct {
+		req   Request
+		err   string // part of the error, or "" if the request succeeds
+		check func(Response) bool
+	}{
+		{Request{Op: "status"}, "", func(res Response) bool { return len(res.Servers) == 3 }},
+		{Request{Op: "leader"}, "", func(res Response) bool { return *res.Server == leader }},
+		{Request{Op: "propose", Command: "x", Wait: true}, "", func(res Response) bool {
+			return *res.Server == leader && *res.Index == 0 && *res.Applied
+		}},
+		{Request{Op: "propose", Command: "y", Server: ref((leader + 1) % 3)}, "no server took the proposal", nil},
+		{Request{Op: "log", Server: ref(leader), To: ref(1)}, "", func(res Response) bool {
+			return len(res.Entries) == 1 && res.Entries[0] == Entry{0, "x"}
+		}},
+		{Request{Op: "log"}, "log needs a server", nil},
+		{Request{Op: "status", Server: ref(3)}, "no server 3", nil},
+		{Request{Op: "partition", Groups: [][]int{{0, 1}, {5}}}, "no server 5", nil},
+		{Request{Op: "partition", Groups: [][]int{{0, 1}, {2}}}, "", func(res Response) bool {
+			s := c.status()
+			return s[0].Partition == 0 && s[1].Partition == 0 && s[2].Partition == 1
+		}},
+		{Request{Op: "heal"}, "", func(res Response) bool {
+			s := c.status()
+			return s[0].Partition == 0 && s[1].Partition == 0 && s[2].Partition == 0
+		}},
+		{Request{Op: "compact"}, `unknown op "compact"`, nil},
+	}
+	for i, tt := range tests {
+		res := c.handle(&tt.req)
+		if tt.err != "" {
+			if res.Ok || !strings.Contains(res.Error, tt.err) {
+				t.Fatalf("%v (%+v): got %+v, expected an error containing %q", i, tt.req, res, tt.err)
+			}
+			continue
+		}
+		if !res.Ok {
+			t.Fatalf("%v (%+v): %v", i, tt.req, res.Error)
+		}
+		if tt.check != nil && !tt.check(res) {
+			t.Fatalf("%v (%+v): unexpected response %+v", i, tt.req, res)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Command omnipaxosd runs an OmniPaxos cluster for development. It hosts
+// every server of a cluster file in one process, on the labrpc network
+// the tests use, with the network faults the file asks for, and serves a
+// newline-delimited JSON API (see api.go) to propose commands, inspect
+// the servers and partition them. omnipaxosctl is a client for it.
+//
+//	omnipaxosd -cluster cluster.json
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+
+	"omnipaxos"
+
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	path := flag.String("cluster", "cluster.json", "cluster file")
+	logLevel := flag.Int("loglevel", 2, "log level (-1=trace, 0=debug, 1=info, 2=warn, 3=error)")
+	pretty := flag.Bool("pretty", true, "pretty-print logs")
+	flag.Parse()
+	omnipaxos.SetupLogger(*logLevel, *pretty)
+
+	cf, err := readClusterFile(*path)
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
+	}
+	l, err := net.Listen("tcp", cf.Listen)
+	if err != nil {
+		log.Fatal().Msgf("listen: %v", err)
+	}
+	c, err := startCluster(cf)
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
+	}
+	log.Warn().Msgf("%v servers up, client API on %v", cf.Servers, l.Addr())
+	go c.serve(l)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	l.Close()
+	c.stop()
+}
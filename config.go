@@ -12,6 +12,7 @@ package omnipaxos
 import (
 	"bytes"
 	"math/rand"
+	"reflect"
 	"runtime"
 	"sync"
 	"testing"
@@ -49,7 +50,7 @@ type logEntry struct {
 
 type config struct {
 	mu          sync.Mutex
-	t           *testing.T
+	t           testing.TB
 	net         *labrpc.Network
 	n           int
 	paxos       []*OmniPaxos // protected by `mu`
@@ -60,21 +61,31 @@ type config struct {
 	didRecv     []bool             // did receive any message from each server; protected by `mu`
 	nextIndex   []int              // protected by `mu`
 	numCommands []int              // number of commited valid commands for each server; protect by `mu`
+	stopSigns   map[int]StopSign   // decided StopSigns by index; protected by `mu`
+	keyOf       KeyFunc            // log cleaning key function given to every server; protected by `mu`
+	paxosConfig Config             // given to every server
 	start       time.Time          // time at which makeConfig() was called
 	// begin()/end() statistics
-	t0        time.Time // time at which test_test.go called cfg.begin()
-	rpcs0     int       // rpcTotal() at start of test
-	bytes0    int64
-	maxIndex  int // protected by `mu`
-	maxIndex0 int
-	stopCh    []chan struct{}
+	t0          time.Time // time at which test_test.go called cfg.begin()
+	rpcs0       int       // rpcTotal() at start of test
+	bytes0      int64
+	maxIndex    int // protected by `mu`
+	maxIndex0   int
+	incs0       int // ballotIncrements() at start of test
+	stopCh      []chan struct{}
+	retiredIncs int // ballot increments of crashed servers; protected by `mu`
 
 	// TODO add more fields for OmniPaxos testing here.
 }
 
 var ncpuOnce sync.Once
 
-func makeConfig(t *testing.T, n int, unreliable bool, snapshot bool) *config {
+func makeConfig(t testing.TB, n int, unreliable bool, snapshot bool) *config {
+	return makeConfigWith(t, n, unreliable, snapshot, DefaultConfig())
+}
+
+// makeConfigWith is makeConfig with servers started by MakeWithConfig
+func makeConfigWith(t testing.TB, n int, unreliable bool, snapshot bool, paxosConfig Config) *config {
 	ncpuOnce.Do(func() {
 		if runtime.NumCPU() < 2 {
 			log.Warn().Msgf("Only one CPU, which may conceal locking bugs")
@@ -94,14 +105,19 @@ func makeConfig(t *testing.T, n int, unreliable bool, snapshot bool) *config {
 	cfg.didRecv = make([]bool, cfg.n)
 	cfg.nextIndex = make([]int, cfg.n)
 	cfg.numCommands = make([]int, cfg.n)
+	cfg.stopSigns = map[int]StopSign{}
 	cfg.start = time.Now()
 	cfg.stopCh = make([]chan struct{}, cfg.n)
+	cfg.paxosConfig = paxosConfig
 
 	cfg.setunreliable(unreliable)
 
 	cfg.net.LongDelays(false)
 
 	applier := cfg.applier
+	if snapshot {
+		applier = cfg.applierSnap
+	}
 
 	for i := 0; i < cfg.n; i++ {
 		cfg.logs[i] = map[int]logEntry{}
@@ -138,7 +154,9 @@ func (cfg *config) crash1(i int) {
 		cfg.mu.Unlock()
 		close(cfg.stopCh[i])
 		rf.Kill()
+		stats := rf.BLEStats()
 		cfg.mu.Lock()
+		cfg.retiredIncs += stats.BallotIncrements
 		cfg.paxos[i] = nil
 	}
 
@@ -185,6 +203,20 @@ func (cfg *config) apply(server int, m ApplyMsg) {
 	}
 	cfg.nextIndex[server]++
 
+	if !m.CommandValid && !m.StopSignValid {
+		// removed by log cleaning, a later entry superseded it
+		return
+	}
+
+	if m.StopSignValid {
+		ss, ok := cfg.stopSigns[m.CommandIndex]
+		if ok && !reflect.DeepEqual(ss, m.StopSign) {
+			log.Fatal().Int("Server", server).Msgf("decided StopSign %+v at index %d but another server decided %+v",
+				m.StopSign, m.CommandIndex, ss)
+		}
+		cfg.stopSigns[m.CommandIndex] = m.StopSign
+	}
+
 	logEntry := logEntry{m.CommandValid, m.Command}
 	cfg.checkConsistency(server, m.CommandIndex, logEntry)
 	cfg.logs[server][m.CommandIndex] = logEntry
@@ -220,6 +252,71 @@ func (cfg *config) applier(server int, applyCh chan ApplyMsg, stopCh <-chan stru
 	}
 }
 
+// applierUnchecked drains applyCh without checking what it applies, for
+// tests that make servers disagree on purpose
+func (cfg *config) applierUnchecked(server int, applyCh chan ApplyMsg, stopCh <-chan struct{}) {
+	for range applyCh {
+	}
+}
+
+const SnapShotInterval = 10
+
+// applierSnap is like applier, but also asks the server to snapshot
+// every SnapShotInterval entries, and checks the snapshots it is
+// handed back against the committed logs.
+func (cfg *config) applierSnap(server int, applyCh chan ApplyMsg, stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			{
+				// When applier is stopped, it still continues to empty `applyCh`.
+				stopCh = nil
+			}
+		case m, ok := <-applyCh:
+			{
+				if !ok {
+					return
+				}
+				if stopCh == nil {
+					continue
+				}
+				if m.SnapshotValid {
+					cfg.ingestSnap(server, m.Snapshot, m.SnapshotIndex)
+					continue
+				}
+				cfg.apply(server, m)
+				if v, ok := m.Command.(int); ok && m.CommandValid && (m.CommandIndex+1)%SnapShotInterval == 0 {
+					cfg.mu.Lock()
+					op := cfg.paxos[server]
+					cfg.mu.Unlock()
+					if op != nil {
+						op.Snapshot(m.CommandIndex, encodeSnapshot(v))
+					}
+				}
+			}
+		}
+	}
+}
+
+// ingestSnap checks a snapshot delivered on applyCh and moves the
+// server's expected next index past it.
+func (cfg *config) ingestSnap(server int, snapshot []byte, index int) {
+	v, err := decodeSnapshot(snapshot)
+	if err != nil {
+		log.Fatal().Int("Server", server).Msgf("could not decode snapshot at index %d: %v", index, err)
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if index < cfg.nextIndex[server]-1 {
+		log.Fatal().Int("Server", server).Msgf("Snapshot at index %d but already applied up to %d",
+			index, cfg.nextIndex[server]-1)
+	}
+	cfg.checkCommitted(index, v)
+	cfg.logs[server][index] = logEntry{true, v}
+	cfg.nextIndex[server] = index + 1
+	cfg.didRecv[server] = true
+}
+
 // Check that `command` has been committed at `index`
 // Requires mutex `mu`.
 func (cfg *config) checkCommitted(index int, command interface{}) {
@@ -255,6 +352,67 @@ func encodeSnapshot(v int) []byte {
 	return buf.Bytes()
 }
 
+// restartFrom crashes every server and starts it again from state and
+// snapshot, the way the servers of a new configuration start from the
+// log of the old one.
+func (cfg *config) restartFrom(state []byte, snapshot []byte, applier func(int, chan ApplyMsg, <-chan struct{})) {
+	for i := 0; i < cfg.n; i++ {
+		cfg.crash1(i)
+	}
+	cfg.mu.Lock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.saved[i] = MakePersister()
+		cfg.saved[i].SaveStateAndSnapshot(state, snapshot)
+		cfg.logs[i] = map[int]logEntry{}
+	}
+	cfg.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.start1(i, applier)
+		cfg.connect(i)
+	}
+}
+
+// enableLogCleaning turns on log cleaning with keyOf on every server,
+// including ones started later.
+func (cfg *config) enableLogCleaning(keyOf KeyFunc) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.keyOf = keyOf
+	for i := 0; i < cfg.n; i++ {
+		if cfg.paxos[i] != nil {
+			cfg.paxos[i].SetKeyFunc(keyOf)
+		}
+	}
+}
+
+// make server i's clock, which times leases, run at rate times real time
+func (cfg *config) skewClock(i int, rate float64) {
+	op := cfg.paxos[i]
+	start := time.Now()
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.clock = func() time.Time {
+		return start.Add(time.Duration(float64(time.Since(start)) * rate))
+	}
+}
+
+// make server i run its BLE rounds every period instead of every 100ms
+func (cfg *config) slowHeartbeats(i int, period time.Duration) {
+	op := cfg.paxos[i]
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.delay = period
+}
+
+// make server i, as leader, send peer forged(peer, entries) instead of
+// the entries of its Accepts; nil stops it
+func (cfg *config) equivocate(i int, forged func(peer int, entries []any) []any) {
+	op := cfg.paxos[i]
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.equivocate = forged
+}
+
 // start or re-start a cluster.
 // if one already exists, "kill" it first.
 // allocate new outgoing port file names, and a new
@@ -297,10 +455,16 @@ func (cfg *config) start1(i int, applier func(int, chan ApplyMsg, <-chan struct{
 	cfg.stopCh[i] = make(chan struct{})
 	go applier(i, applyCh, cfg.stopCh[i])
 
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	rf, err := MakeWithConfig(ends, i, cfg.saved[i], applyCh, cfg.paxosConfig)
+	if err != nil {
+		cfg.t.Fatalf("MakeWithConfig: %v", err)
+	}
 
 	cfg.mu.Lock()
 	cfg.paxos[i] = rf
+	if cfg.keyOf != nil {
+		rf.SetKeyFunc(cfg.keyOf)
+	}
 
 	cfg.didRecv[i] = false
 	log.Trace().Msgf("Resetting didRecv[%d] to false as new server is created", i)
@@ -430,6 +594,23 @@ func (cfg *config) rpcCount(server int) int {
 	return cfg.net.GetCount(server)
 }
 
+// ballotIncrements returns how often the servers raised their ballots,
+// counting servers that have since crashed
+func (cfg *config) ballotIncrements() int {
+	cfg.mu.Lock()
+	n := cfg.retiredIncs
+	paxos := append([]*OmniPaxos{}, cfg.paxos...)
+	cfg.mu.Unlock()
+	// BLEStats takes op.mu, which the applier may hold while it waits for
+	// cfg.mu
+	for _, op := range paxos {
+		if op != nil {
+			n += op.BLEStats().BallotIncrements
+		}
+	}
+	return n
+}
+
 func (cfg *config) rpcTotal() int {
 	return cfg.net.GetTotalCount()
 }
@@ -628,6 +809,7 @@ func (cfg *config) begin(description string) {
 	cfg.rpcs0 = cfg.rpcTotal()
 	cfg.bytes0 = cfg.bytesTotal()
 	cfg.maxIndex0 = cfg.maxIndex
+	cfg.incs0 = cfg.ballotIncrements()
 	// TODO: PG See if this is even needed?
 	time.Sleep(500 * time.Millisecond)
 }
@@ -647,9 +829,10 @@ func (cfg *config) end() {
 		nbytes := cfg.bytesTotal() - cfg.bytes0 // number of bytes
 		ncmds := cfg.maxIndex - cfg.maxIndex0   // number of agreements reported
 		cfg.mu.Unlock()
+		nincs := cfg.ballotIncrements() - cfg.incs0 // number of ballot increments
 
 		fmt.Printf("  ... Passed --")
-		fmt.Printf("  %4.1f  %d %4d %7d %4d\n", t, npeers, nrpc, nbytes, ncmds)
+		fmt.Printf("  %4.1f  %d %4d %7d %4d %3d\n", t, npeers, nrpc, nbytes, ncmds, nincs)
 	}
 }
 
@@ -0,0 +1,219 @@
+package omnipaxos
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Equivocation detection. A correct leader sends every follower the same
+// entry for a given ballot and index. Followers record a digest of each
+// entry they accept from an Accept, and repeat the digests of the last
+// few rounds on their heartbeats. A server that finds a peer's digest
+// differs from its own for the same ballot and index raises an alert,
+// and stops acknowledging and deciding anything of that ballot: one of
+// the two entries cannot be what the others decided.
+//
+// The distrust ends with the ballot. A server that distrusts the ballot
+// of the leader it follows raises its own ballot, as in a takeover, so
+// BLE elects a new one whose entries are acknowledged as usual.
+
+// rounds of digests each heartbeat carries, and rounds they are kept
+// to compare with the peers' heartbeats; a heartbeat carries at most
+// maxHBDigests, the most recent ones, however many entries we accepted
+const (
+	digestRounds     = 3
+	digestKeepRounds = 20
+	maxHBDigests     = 256
+)
+
+// EntryDigest is the digest of the entry accepted at Index in ballot N
+type EntryDigest struct {
+	N      BallotNumber
+	Index  int
+	Digest uint64
+}
+
+// Equivocation records two different entries accepted at the same ballot
+// and index: ours, and the one Peer accepted
+type Equivocation struct {
+	N      BallotNumber
+	Index  int
+	Peer   int
+	Mine   uint64
+	Theirs uint64
+}
+
+type digestKey struct {
+	n     BallotNumber
+	index int
+}
+
+// a digest recorded in BLE round rnd
+type recordedDigest struct {
+	EntryDigest
+	rnd int
+}
+
+// digest hashes a canonical encoding of entry, so that every copy of an
+// entry has the same digest, however it reached the server
+func digest(entry any) uint64 {
+	h := fnv.New64a()
+	writeCanonical(h, reflect.ValueOf(entry))
+	return h.Sum64()
+}
+
+// writeCanonical encodes what gob sends of v: exported fields, the values
+// pointers point to, and map entries in sorted order. A nil pointer, slice
+// or map encodes like an empty one, as gob leaves both out.
+func writeCanonical(w io.Writer, v reflect.Value) {
+	if !v.IsValid() {
+		io.WriteString(w, "nil;")
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			io.WriteString(w, "nil;")
+			return
+		}
+		writeCanonical(w, v.Elem())
+	case reflect.Pointer:
+		if v.IsNil() {
+			writeCanonical(w, reflect.Zero(v.Type().Elem()))
+			return
+		}
+		writeCanonical(w, v.Elem())
+	case reflect.Struct:
+		fmt.Fprintf(w, "%v{", v.Type())
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				writeCanonical(w, v.Field(i))
+			}
+		}
+		io.WriteString(w, "}")
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(w, "%v[%d", v.Type(), v.Len())
+		for i := range v.Len() {
+			writeCanonical(w, v.Index(i))
+		}
+		io.WriteString(w, "]")
+	case reflect.Map:
+		pairs := make([]string, 0, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			var pair bytes.Buffer
+			writeCanonical(&pair, it.Key())
+			writeCanonical(&pair, it.Value())
+			pairs = append(pairs, pair.String())
+		}
+		sort.Strings(pairs)
+		fmt.Fprintf(w, "%v{%d", v.Type(), len(pairs))
+		for _, pair := range pairs {
+			io.WriteString(w, pair)
+		}
+		io.WriteString(w, "}")
+	case reflect.Bool:
+		fmt.Fprintf(w, "%v:%v;", v.Type(), v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(w, "%v:%d;", v.Type(), v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprintf(w, "%v:%d;", v.Type(), v.Uint())
+	case reflect.Float32, reflect.Float64:
+		fmt.Fprintf(w, "%v:%v;", v.Type(), v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		fmt.Fprintf(w, "%v:%v;", v.Type(), v.Complex())
+	case reflect.String:
+		fmt.Fprintf(w, "%v:%q;", v.Type(), v.String())
+	default:
+		// channels and functions: gob does not send them
+		fmt.Fprintf(w, "%v;", v.Type())
+	}
+}
+
+// recordDigest remembers the entry leader sent us at index in ballot n.
+// Must hold op.mu.
+func (op *OmniPaxos) recordDigest(leader int, n BallotNumber, index int, entry any) {
+	d := EntryDigest{n, index, digest(entry)}
+	key := digestKey{n, index}
+	if mine, ok := op.digests[key]; ok {
+		if mine != d.Digest {
+			// the leader itself sent us two different entries
+			op.alertEquivocation(leader, d, mine)
+		}
+		return
+	}
+	op.digests[key] = d.Digest
+	op.digestLog = append(op.digestLog, recordedDigest{d, op.R})
+}
+
+// recentDigests forgets digests older than digestKeepRounds, and returns
+// those of the last digestRounds rounds, at most maxHBDigests of them, for
+// a heartbeat. Must hold op.mu.
+func (op *OmniPaxos) recentDigests() []EntryDigest {
+	drop := 0
+	for drop < len(op.digestLog) && op.digestLog[drop].rnd < op.R-digestKeepRounds {
+		delete(op.digests, digestKey{op.digestLog[drop].N, op.digestLog[drop].Index})
+		drop++
+	}
+	op.digestLog = op.digestLog[drop:]
+
+	var recent []EntryDigest
+	for _, r := range op.digestLog[max(len(op.digestLog)-maxHBDigests, 0):] {
+		if r.rnd >= op.R-digestRounds {
+			recent = append(recent, r.EntryDigest)
+		}
+	}
+	return recent
+}
+
+// checkDigests compares the digests on peer's heartbeat with ours. Must
+// hold op.mu.
+func (op *OmniPaxos) checkDigests(peer int, digests []EntryDigest) {
+	for _, d := range digests {
+		if mine, ok := op.digests[digestKey{d.N, d.Index}]; ok && mine != d.Digest {
+			op.alertEquivocation(peer, d, mine)
+		}
+	}
+}
+
+// Must hold op.mu.
+func (op *OmniPaxos) alertEquivocation(peer int, theirs EntryDigest, mine uint64) {
+	for _, e := range op.equivocations {
+		if e.N == theirs.N && e.Index == theirs.Index {
+			return
+		}
+	}
+	log.Error().Msgf("Server %v: EQUIVOCATION in ballot %v at index %v: we accepted %x, server %v accepted %x; no longer acknowledging ballot %v",
+		op.me, theirs.N, theirs.Index, mine, peer, theirs.Digest, theirs.N)
+	op.equivocations = append(op.equivocations, Equivocation{theirs.N, theirs.Index, peer, mine, theirs.Digest})
+	if theirs.N == op.L && op.L.Pid != op.me {
+		// nothing more is decided in this ballot; have BLE elect another
+		op.B = BallotNumber{op.L.Value + 1, op.B.Priority, op.B.Pid}
+		op.bleStats.BallotIncrements++
+		op.qc = true
+		op.persist()
+	}
+}
+
+// distrusts reports whether an equivocation was seen in ballot n. Must
+// hold op.mu.
+func (op *OmniPaxos) distrusts(n BallotNumber) bool {
+	for _, e := range op.equivocations {
+		if e.N == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Equivocations returns the equivocations this server has detected
+func (op *OmniPaxos) Equivocations() []Equivocation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return append([]Equivocation(nil), op.equivocations...)
+}
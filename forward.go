@@ -0,0 +1,56 @@
+package omnipaxos
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Proposal forwarding. With forwarding on, a follower that is asked to
+// propose a command relays it to the leader BLE elected, and returns the
+// index the leader assigned it. A forwarded proposal is never forwarded
+// again: during a leader change two servers may each believe the other
+// is the leader, and the proposal fails instead of bouncing between them.
+
+type ForwardProposalRequest struct {
+	Me      int
+	Command any
+}
+
+type ForwardProposalReply struct {
+	Index  int
+	Ballot int
+	Ok     bool
+}
+
+// SetForwarding turns proposal forwarding on or off
+func (op *OmniPaxos) SetForwarding(on bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.forwarding = on
+}
+
+// forward relays command to the leader, if forwarding is on and we know
+// of a leader other than ourselves
+func (op *OmniPaxos) forward(command any) (int, int, bool) {
+	op.mu.Lock()
+	leader := op.L.Pid
+	// a leader in PREPARE buffers the command itself
+	if !op.forwarding || op.role != FOLLOWER || leader < 0 || leader == op.me {
+		op.mu.Unlock()
+		return -1, -1, false
+	}
+	op.mu.Unlock()
+
+	reply := ForwardProposalReply{}
+	if !op.transport.ForwardProposal(leader, &ForwardProposalRequest{op.me, command}, &reply) {
+		log.Info().Msgf("forward: no response from %v", leader)
+		return -1, -1, false
+	}
+	if !reply.Ok {
+		return -1, -1, false
+	}
+	return reply.Index, reply.Ballot, true
+}
+
+func (op *OmniPaxos) ForwardProposal(args *ForwardProposalRequest, res *ForwardProposalReply) {
+	res.Index, res.Ballot, res.Ok = op.propose(args.Command)
+}
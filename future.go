@@ -0,0 +1,97 @@
+package omnipaxos
+
+import "errors"
+
+// Proposal futures. ProposeAsync returns a channel that receives exactly
+// one ProposalResult: the index the command was decided at, or an error
+// saying why this server can no longer tell. A command that failed with
+// ErrLeaderChanged may still be decided by the new leader; clients that
+// retry should use sessions (see session.go) so it is applied once.
+
+var (
+	ErrNotLeader     = errors.New("omnipaxos: not the leader")
+	ErrLeaderChanged = errors.New("omnipaxos: leader changed before the entry was decided")
+	ErrOverwritten   = errors.New("omnipaxos: entry overwritten by another leader")
+	ErrKilled        = errors.New("omnipaxos: server killed")
+	ErrStopped       = errors.New("omnipaxos: configuration stopped")
+	ErrNilCommand    = errors.New("omnipaxos: nil command")
+)
+
+type ProposalResult struct {
+	Index  int
+	Ballot int
+	Err    error
+}
+
+// a proposal waiting for its entry to be decided
+type pendingProposal struct {
+	ch     chan ProposalResult
+	ballot int
+	digest uint64 // of the command, see equivocation.go
+}
+
+// ProposeAsync proposes command, and returns a channel that receives the
+// outcome once the entry is decided or lost.
+func (op *OmniPaxos) ProposeAsync(command any) <-chan ProposalResult {
+	ch := make(chan ProposalResult, 1)
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if op.killed() {
+		ch <- ProposalResult{Index: -1, Ballot: -1, Err: ErrKilled}
+		return ch
+	}
+	if command == nil {
+		ch <- ProposalResult{Index: -1, Ballot: -1, Err: ErrNilCommand}
+		return ch
+	}
+	if op.stopped() {
+		ch <- ProposalResult{Index: -1, Ballot: -1, Err: ErrStopped}
+		return ch
+	}
+	index, ballot, ok := op.appendProposal(command)
+	if !ok {
+		ch <- ProposalResult{Index: -1, Ballot: -1, Err: ErrNotLeader}
+		return ch
+	}
+	if index < 0 {
+		// buffered during PREPARE; tracked once it has an index
+		op.buffered[len(op.buffered)-1].future = ch
+		return ch
+	}
+	op.proposals[index] = pendingProposal{ch, ballot, digest(command)}
+	return ch
+}
+
+// resolveProposals completes the proposals whose entries are decided. A
+// proposal only succeeds if the decided entry is its command. Must hold
+// op.mu.
+func (op *OmniPaxos) resolveProposals() {
+	for index, p := range op.proposals {
+		if index >= op.decidedIdx {
+			continue
+		}
+		res := ProposalResult{Index: index, Ballot: p.ballot}
+		if index < op.compactedIdx {
+			// decided within a snapshot we installed, which may or may
+			// not hold the command
+			res.Err = ErrLeaderChanged
+		} else if digest(op.log[index-op.compactedIdx]) != p.digest {
+			res.Err = ErrOverwritten
+		}
+		p.ch <- res
+		delete(op.proposals, index)
+	}
+}
+
+// failProposals fails the pending proposals at from and later with err.
+// Must hold op.mu.
+func (op *OmniPaxos) failProposals(from int, err error) {
+	for index, p := range op.proposals {
+		if index >= from {
+			p.ch <- ProposalResult{Index: index, Ballot: p.ballot, Err: err}
+			delete(op.proposals, index)
+		}
+	}
+}
@@ -9,6 +9,12 @@ import (
 
 type HBRequest struct {
 	Rnd int
+	// an idle leader's decidedIdx, for followers that missed the Decide.
+	// DecIdx is -1 if the sender is not an accepting leader.
+	N       BallotNumber
+	DecIdx  int
+	Me      int
+	Digests []EntryDigest // of the entries we accepted lately (see equivocation.go)
 }
 
 type PrepareRecoveringFollowerRequest struct {
@@ -18,39 +24,57 @@ type PrepareRecoveringFollowerRequest struct {
 type HBReply struct {
 	Rnd    int
 	Ballot Ballot
+	Lease  bool // granted the sender a lease for N
 }
 type DummyReply struct{}
 
-func (op *OmniPaxos) sendHBRequest(wg *sync.WaitGroup, ballotsCh chan Ballot, timeoutCh <-chan time.Time) {
+// sendHBRequest sends this round's heartbeats. Replies go to ballotsCh,
+// which has room for all of them, without waiting for op.mu: a busy
+// server still hears its peers in time.
+func (op *OmniPaxos) sendHBRequest(wg *sync.WaitGroup, ballotsCh chan Ballot) {
 	op.mu.Lock()
 	role := op.role
 	phase := op.phase
+	req := HBRequest{op.R, op.currentRnd, -1, op.me, op.recentDigests()}
+	if role == LEADER && phase == ACCEPT {
+		req.DecIdx = op.decidedIdx
+	}
+	// a lease granted in reply to this round starts no earlier than now
+	sent := op.clock()
+	leaseAcks := 1
 	op.mu.Unlock()
 
 	log.Info().Msgf("send HB Request (%v) [%v | %v] Heartbeat being made!", op.me, role, phase)
 
 	// iterate over peers and send those requests
-	for i, peer := range op.peers {
+	for i := range op.npeers {
 		if i == op.me {
 			continue
 		}
 		wg.Add(1)
-		i, peer := i, peer // capture loop variables
+		i := i // capture loop variable
 		go func() {
 			defer wg.Done()
 			reply := HBReply{}
-			if !peer.Call("OmniPaxos.ReceiveHBRequest", &HBRequest{op.R}, &reply) {
-				log.Info().Msgf("startTimer(%v): no heartbeat from %v", op.R, i)
+			start := time.Now()
+			if !op.transport.HB(i, &req, &reply) {
+				log.Info().Msgf("startTimer(%v): no heartbeat from %v", req.Rnd, i)
 				return
 			}
+			rtt := time.Since(start)
+			ballotsCh <- reply.Ballot
+
 			op.mu.Lock()
 			defer op.mu.Unlock()
-
-			if reply.Rnd == op.R {
-				select {
-				case ballotsCh <- reply.Ballot:
-				case <-timeoutCh:
-					return
+			op.observeRTT(i, rtt)
+
+			if reply.Lease {
+				leaseAcks++
+				if leaseAcks > op.npeers/2 && op.role == LEADER && op.currentRnd == req.N {
+					if op.leaseRnd != req.N || op.leaseUntil.Before(sent.Add(op.leaderLease())) {
+						op.leaseRnd = req.N
+						op.leaseUntil = sent.Add(op.leaderLease())
+					}
 				}
 			}
 		}()
@@ -60,31 +84,34 @@ func (op *OmniPaxos) ReceiveHBRequest(args *HBRequest, res *HBReply) {
 	op.mu.Lock()
 	defer op.mu.Unlock()
 
-	// past 3 rounds heart beat
-	op.LinkLastHBRound = max(args.Rnd, op.LinkLastHBRound)
+	// past 3 rounds heart beat. Rounds are counted in our own rounds:
+	// the sender's round restarts from 0 when it crashes.
+	op.LinkLastHBRound = op.R
 
-	// if need to recover
+	// if need to recover. The leader has nobody to recover from, and
+	// the next round of BLE decides whether it stays leader.
+	if op.LinkDrop && op.L.Pid == op.me {
+		op.LinkDrop = false
+	}
 	if op.LinkDrop {
 		op.LinkDrop = false
 		op.role = FOLLOWER
 		op.phase = RECOVER
 
-		for i, peer := range op.peers {
-			if i == op.me {
-				continue
+		for i := range op.npeers {
+			if i != op.me {
+				op.send(i, &PrepareRecoveringFollowerRequest{op.me})
 			}
-			peer := peer
-			go func() {
-				op.serializeCh <- struct{}{}        // acquire semaphore
-				defer func() { <-op.serializeCh }() // release
-				if !peer.Call("OmniPaxos.PrepareRecoveringFollower", &PrepareRecoveringFollowerRequest{op.me}, &DummyReply{}) {
-					log.Info().Msgf("no response from peer when attempting to recover")
-					return
-				}
-			}()
 		}
 	}
 
+	op.checkDigests(args.Me, args.Digests)
+
+	if args.DecIdx >= 0 {
+		op.learnDecided(args.N, args.DecIdx)
+		res.Lease = op.grantLease(args.N)
+	}
+
 	rnd := args.Rnd
 	res.Rnd = rnd
 	res.Ballot = Ballot{op.B, op.qc}
@@ -98,20 +125,7 @@ func (op *OmniPaxos) PrepareRecoveringFollower(args *PrepareRecoveringFollowerRe
 		return
 	}
 
-	follower := op.peers[args.Me]
-	currentRnd := op.currentRnd
-	acceptedRnd := op.acceptedRnd
-	logSize := len(op.log)
-	decIdx := op.decidedIdx
-
-	go func() {
-		op.serializeCh <- struct{}{}        // acquire semaphore
-		defer func() { <-op.serializeCh }() // release
-		if !follower.Call("OmniPaxos.RecievePrepare", &PrepareRequest{op.me, currentRnd, acceptedRnd, logSize, decIdx}, &DummyReply{}) {
-			log.Info().Msgf("recieve prepare failed")
-		}
-	}()
-
+	op.send(args.Me, &PrepareRequest{op.me, op.currentRnd, op.acceptedRnd, op.logLen(), op.decidedIdx})
 }
 
 // called when reconnecting to single peer
@@ -126,14 +140,11 @@ func (op *OmniPaxos) reconnected(pid int) {
 		op.role = FOLLOWER
 		op.phase = RECOVER
 		op.Info("reconnected to %v, state: %v %v", pid, op.role, op.phase)
-		prepareRecoveryRequest := PrepareRecoveringFollowerRequest{op.me}
-		peer := op.peers[pid]
-		go func() {
-			op.serializeCh <- struct{}{}        // acquire semaphore
-			defer func() { <-op.serializeCh }() // release
-			if !peer.Call("OmniPaxos.PrepareRecoveringFollower", &prepareRecoveryRequest, &DummyReply{}) {
-				op.Info("PrepareRecoveringFollower failed to %v", pid)
-			}
-		}()
+		op.sendPrepareRecoveringFollower(pid)
 	}
 }
+
+// ask the leader pid to resynchronize this server's log
+func (op *OmniPaxos) sendPrepareRecoveringFollower(pid int) {
+	op.send(pid, &PrepareRecoveringFollowerRequest{op.me})
+}
@@ -30,12 +30,45 @@ func (p Phase) String() string {
 	}
 }
 
-// TODO make this a real implementation
+// stopped returns true once this configuration's log ends in a StopSign,
+// after which nothing more can be appended. A StopSign before configIdx
+// ended the previous configuration. Must hold op.mu.
 func (op *OmniPaxos) stopped() bool {
-	return op.killed()
+	if op.killed() {
+		return true
+	}
+	n := len(op.log)
+	return n > 0 && op.logLen() > op.configIdx && isStopSign(op.log[n-1])
+}
+
+// receivedLen returns the length of the longest prefix of the log that has
+// no holes. Accepts may arrive out of order, in which case AcceptFromLeader
+// pads the log with nil entries until the missing ones show up.
+func (op *OmniPaxos) receivedLen() int {
+	n := max(op.decidedIdx, op.compactedIdx, 0)
+	for n < op.logLen() && op.log[n-op.compactedIdx] != nil {
+		n++
+	}
+	return n
+}
+
+// logLen returns the length of the log, including compacted entries.
+func (op *OmniPaxos) logLen() int {
+	return op.compactedIdx + len(op.log)
+}
+
+// advanceDecided moves decidedIdx up to what the leader has decided, but
+// never past a hole in the log. The missing entries may still be in
+// flight; startTimer resynchronizes with the leader if they were lost.
+func (op *OmniPaxos) advanceDecided() {
+	op.setDecided(min(op.leaderDecIdx, op.receivedLen()))
 }
 
+// prefix and suffix take absolute indices. Compacted entries are no longer
+// in op.log: a prefix ending inside them is empty, and callers must check
+// compactedIdx before asking for a suffix that starts inside them.
 func (op *OmniPaxos) prefix(idx int) []any {
+	idx -= op.compactedIdx
 	if idx < 0 {
 		return []any{}
 	}
@@ -46,6 +79,7 @@ func (op *OmniPaxos) prefix(idx int) []any {
 }
 
 func (op *OmniPaxos) suffix(idx int) []any {
+	idx -= op.compactedIdx
 	if idx < 0 {
 		return op.log
 	}
@@ -0,0 +1,74 @@
+package kvpaxos
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	"omnipaxos/labrpc"
+)
+
+type Clerk struct {
+	servers  []*labrpc.ClientEnd
+	clientID int64
+	seq      int64 // of the last command
+	leader   int   // the server that answered last
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+func MakeClerk(servers []*labrpc.ClientEnd) *Clerk {
+	ck := new(Clerk)
+	ck.servers = servers
+	ck.clientID = nrand()
+	return ck
+}
+
+// Get fetches the current value for a key, or "" if the key does not
+// exist. It keeps trying, at every server in turn, until one answers.
+func (ck *Clerk) Get(key string) string {
+	ck.seq++
+	args := GetArgs{key, ck.clientID, ck.seq}
+	for ; ; ck.next() {
+		reply := GetReply{}
+		ok := ck.servers[ck.leader].Call("KVServer.Get", &args, &reply)
+		if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+			return reply.Value
+		}
+	}
+}
+
+// PutAppend is shared by Put and Append. It keeps trying, with the same
+// Seq, until a server reports the command applied.
+func (ck *Clerk) PutAppend(key string, value string, op string) {
+	ck.seq++
+	args := PutAppendArgs{key, value, op, ck.clientID, ck.seq}
+	for ; ; ck.next() {
+		reply := PutAppendReply{}
+		ok := ck.servers[ck.leader].Call("KVServer.PutAppend", &args, &reply)
+		if ok && reply.Err == OK {
+			return
+		}
+	}
+}
+
+func (ck *Clerk) Put(key string, value string) {
+	ck.PutAppend(key, value, "Put")
+}
+
+func (ck *Clerk) Append(key string, value string) {
+	ck.PutAppend(key, value, "Append")
+}
+
+// next moves on to the next server, and pauses after trying them all
+// while a new leader is elected
+func (ck *Clerk) next() {
+	ck.leader = (ck.leader + 1) % len(ck.servers)
+	if ck.leader == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
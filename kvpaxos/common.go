@@ -0,0 +1,39 @@
+// Package kvpaxos is a key/value service replicated with OmniPaxos. Every
+// Get, Put and Append goes through the log, and each server applies the
+// decided commands to its own copy of the data. Clerks number their
+// commands, and Puts and Appends are proposed as OmniPaxos session
+// commands, so a retried command is applied only once.
+package kvpaxos
+
+const (
+	OK             = "OK"
+	ErrNoKey       = "ErrNoKey"
+	ErrWrongLeader = "ErrWrongLeader"
+	ErrTimeout     = "ErrTimeout"
+)
+
+type Err string
+
+// Put or Append
+type PutAppendArgs struct {
+	Key      string
+	Value    string
+	Op       string // "Put" or "Append"
+	ClientID int64
+	Seq      int64
+}
+
+type PutAppendReply struct {
+	Err Err
+}
+
+type GetArgs struct {
+	Key      string
+	ClientID int64
+	Seq      int64
+}
+
+type GetReply struct {
+	Err   Err
+	Value string
+}
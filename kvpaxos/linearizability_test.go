@@ -0,0 +1,203 @@
+package kvpaxos
+
+import (
+	"sort"
+	"strings"
+)
+
+// A linearizability checker for key/value histories, after Wing and
+// Gong's search with the memoization of Lowe's: it looks for an order of
+// the operations that respects their real-time order and explains every
+// Get. Keys are independent, so each key's operations are checked on
+// their own.
+//
+// While no Put is left to linearize, values only grow, so an Append may
+// only be linearized if its result is a prefix of what every Get left to
+// linearize returned. Without this, concurrent Appends followed by a Get
+// would have the search try their orders one by one.
+
+// Operation is a Get, Put or Append as a clerk saw it: what it asked,
+// what it got back, and when it called and returned
+type Operation struct {
+	Op     string // "Get", "Put" or "Append"
+	Key    string
+	Value  string // of a Put or Append
+	Output string // of a Get
+	Call   int64  // nanoseconds
+	Return int64
+}
+
+// CheckLinearizable reports whether history is linearizable, and a key
+// whose operations are not
+func CheckLinearizable(history []Operation) (bool, string) {
+	byKey := make(map[string][]Operation)
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	for key, ops := range byKey {
+		if !checkKey(ops) {
+			return false, key
+		}
+	}
+	return true, ""
+}
+
+// step applies op to value, and reports whether op could have seen it
+func step(value string, op Operation) (string, bool) {
+	switch op.Op {
+	case "Put":
+		return op.Value, true
+	case "Append":
+		return value + op.Value, true
+	}
+	return value, op.Output == value
+}
+
+// an operation's call or return, in a doubly linked list in time order
+type event struct {
+	id    int
+	match *event // the return of a call; nil for a return
+	prev  *event
+	next  *event
+}
+
+// lift takes a call and its return out of the list
+func lift(e *event) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	r := e.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+// unlift puts them back
+func unlift(e *event) {
+	r := e.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)      { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i int)    { b[i/64] &^= 1 << (i % 64) }
+func (b bitset) has(i int) bool { return b[i/64]&(1<<(i%64)) != 0 }
+
+func (b bitset) key() string {
+	buf := make([]byte, 0, 8*len(b))
+	for _, w := range b {
+		for i := range 8 {
+			buf = append(buf, byte(w>>(8*i)))
+		}
+	}
+	return string(buf)
+}
+
+func checkKey(ops []Operation) bool {
+	type timed struct {
+		at     int64
+		isCall bool
+		id     int
+	}
+	times := make([]timed, 0, 2*len(ops))
+	for id, op := range ops {
+		times = append(times, timed{op.Call, true, id}, timed{op.Return, false, id})
+	}
+	// calls first at equal times: operations that touch are concurrent
+	sort.Slice(times, func(i, j int) bool {
+		if times[i].at != times[j].at {
+			return times[i].at < times[j].at
+		}
+		return times[i].isCall && !times[j].isCall
+	})
+
+	head := &event{id: -1}
+	calls := make([]*event, len(ops))
+	last := head
+	for _, t := range times {
+		e := &event{id: t.id, prev: last}
+		if t.isCall {
+			calls[t.id] = e
+		} else {
+			calls[t.id].match = e
+		}
+		last.next = e
+		last = e
+	}
+
+	type frame struct {
+		call  *event
+		value string
+	}
+	var gets []int
+	puts := 0 // Puts left to linearize
+	for id, op := range ops {
+		switch op.Op {
+		case "Get":
+			gets = append(gets, id)
+		case "Put":
+			puts++
+		}
+	}
+	// whether value could still grow into what every Get left returned
+	plausible := func(linearized bitset, value string) bool {
+		for _, id := range gets {
+			if !linearized.has(id) && !strings.HasPrefix(ops[id].Output, value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var stack []frame
+	linearized := make(bitset, (len(ops)+63)/64)
+	seen := make(map[string]bool)
+	value := ""
+	e := head.next
+	for head.next != nil {
+		if e.match == nil {
+			// a return before its call was linearized: undo the last choice
+			if len(stack) == 0 {
+				return false
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value = top.value
+			linearized.clear(top.call.id)
+			if ops[top.call.id].Op == "Put" {
+				puts++
+			}
+			unlift(top.call)
+			e = top.call.next
+			continue
+		}
+		next, ok := step(value, ops[e.id])
+		if ok && puts == 0 && ops[e.id].Op == "Append" {
+			ok = plausible(linearized, next)
+		}
+		if ok {
+			linearized.set(e.id)
+			state := linearized.key() + "\x00" + next
+			if !seen[state] {
+				seen[state] = true
+				stack = append(stack, frame{e, value})
+				value = next
+				if ops[e.id].Op == "Put" {
+					puts--
+				}
+				lift(e)
+				e = head.next
+				continue
+			}
+			linearized.clear(e.id)
+		}
+		e = e.next
+	}
+	return true
+}
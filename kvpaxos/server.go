@@ -0,0 +1,251 @@
+package kvpaxos
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"omnipaxos"
+	"omnipaxos/labrpc"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how long an RPC handler waits for its command to be applied before it
+// lets the clerk try elsewhere
+const applyTimeout = 800 * time.Millisecond
+
+// Command is what goes in the log. Puts and Appends are wrapped in an
+// omnipaxos.SessionCommand; Gets are not, since reading twice is
+// harmless, and carry their clerk's ClientID and Seq instead so that the
+// handler can recognize its own.
+type Command struct {
+	Op       string // "Get", "Put" or "Append"
+	Key      string
+	Value    string
+	ClientID int64
+	Seq      int64
+}
+
+func init() {
+	gob.Register(Command{})
+}
+
+// applied tells a waiting handler what was applied at its index. ClientID
+// and Seq are 0 if it was a duplicate or came in a snapshot.
+type applied struct {
+	clientID int64
+	seq      int64
+	value    string
+	found    bool
+}
+
+type KVServer struct {
+	mu        sync.Mutex
+	me        int
+	paxos     *omnipaxos.OmniPaxos
+	applyCh   chan omnipaxos.ApplyMsg
+	persister *omnipaxos.Persister
+	dead      int32
+
+	maxpaxosstate int // snapshot if the persisted state grows this big; -1 never
+
+	data        map[string]string
+	lastApplied int                  // index of the last entry applied, or -1
+	waiting     map[int]chan applied // handlers waiting for an index to be applied
+}
+
+func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
+	res, err := kv.submit(Command{"Get", args.Key, "", args.ClientID, args.Seq})
+	if err != OK {
+		reply.Err = err
+		return
+	}
+	if res.clientID != args.ClientID || res.seq != args.Seq {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	reply.Value = res.value
+	reply.Err = OK
+	if !res.found {
+		reply.Err = ErrNoKey
+	}
+}
+
+func (kv *KVServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
+	reply.Err = OK
+	if _, done := kv.paxos.SessionResult(args.ClientID, args.Seq); done {
+		return
+	}
+	cmd := omnipaxos.SessionCommand{
+		ClientID: args.ClientID,
+		Seq:      args.Seq,
+		Command:  Command{args.Op, args.Key, args.Value, args.ClientID, args.Seq},
+	}
+	res, err := kv.submit(cmd)
+	if err == OK && res.clientID == args.ClientID && res.seq == args.Seq {
+		return
+	}
+	// a duplicate of ours, or another command, went in at our index
+	if _, done := kv.paxos.SessionResult(args.ClientID, args.Seq); !done {
+		reply.Err = err
+		if err == OK {
+			reply.Err = ErrWrongLeader
+		}
+	}
+}
+
+// submit proposes cmd, and waits for whatever is applied at its index.
+// It returns ErrTimeout if nothing is applied there within applyTimeout.
+func (kv *KVServer) submit(cmd any) (applied, Err) {
+	index, _, isLeader := kv.paxos.Proposal(cmd)
+	if !isLeader {
+		return applied{}, ErrWrongLeader
+	}
+
+	kv.mu.Lock()
+	if kv.lastApplied >= index {
+		// too late to tell what went in at index
+		kv.mu.Unlock()
+		return applied{}, ErrWrongLeader
+	}
+	ch := make(chan applied, 1)
+	kv.waiting[index] = ch
+	kv.mu.Unlock()
+
+	select {
+	case res := <-ch:
+		return res, OK
+	case <-time.After(applyTimeout):
+		kv.mu.Lock()
+		if kv.waiting[index] == ch {
+			delete(kv.waiting, index)
+		}
+		kv.mu.Unlock()
+		return applied{}, ErrTimeout
+	}
+}
+
+// applier applies the decided commands in log order, and hands each
+// waiting handler the outcome at its index
+func (kv *KVServer) applier() {
+	for m := range kv.applyCh {
+		if kv.killed() {
+			// keep draining, so OmniPaxos never blocks on us
+			continue
+		}
+		kv.mu.Lock()
+		switch {
+		case m.SnapshotValid:
+			if m.SnapshotIndex > kv.lastApplied {
+				kv.readSnapshot(m.Snapshot)
+				kv.notify(m.SnapshotIndex, applied{})
+			}
+		case m.CommandIndex <= kv.lastApplied:
+			// already in our snapshot
+		case m.CommandValid:
+			kv.notify(m.CommandIndex, kv.apply(m.Command))
+		default:
+			// a duplicate, an entry removed by log cleaning or a StopSign
+			kv.notify(m.CommandIndex, applied{})
+		}
+		kv.maybeSnapshot()
+		kv.mu.Unlock()
+	}
+}
+
+// apply applies a command from the log. Must hold kv.mu.
+func (kv *KVServer) apply(entry any) applied {
+	if sc, ok := entry.(omnipaxos.SessionCommand); ok {
+		entry = sc.Command
+	}
+	cmd, ok := entry.(Command)
+	if !ok {
+		log.Error().Msgf("KVServer %v: unknown command %T in the log", kv.me, entry)
+		return applied{}
+	}
+	switch cmd.Op {
+	case "Put":
+		kv.data[cmd.Key] = cmd.Value
+	case "Append":
+		kv.data[cmd.Key] += cmd.Value
+	}
+	value, found := kv.data[cmd.Key]
+	return applied{cmd.ClientID, cmd.Seq, value, found}
+}
+
+// notify records that everything up to index has been applied, and wakes
+// the handlers waiting for those indices. Must hold kv.mu.
+func (kv *KVServer) notify(index int, res applied) {
+	for i := kv.lastApplied + 1; i <= index; i++ {
+		if ch, ok := kv.waiting[i]; ok {
+			delete(kv.waiting, i)
+			if i == index {
+				ch <- res
+			} else {
+				ch <- applied{}
+			}
+		}
+	}
+	kv.lastApplied = index
+}
+
+// maybeSnapshot hands OmniPaxos a snapshot once its persisted state has
+// grown past maxpaxosstate. Must hold kv.mu.
+func (kv *KVServer) maybeSnapshot() {
+	if kv.maxpaxosstate < 0 || kv.lastApplied < 0 || kv.persister.StateSize() < kv.maxpaxosstate {
+		return
+	}
+	w := new(bytes.Buffer)
+	if err := gob.NewEncoder(w).Encode(kv.data); err != nil {
+		log.Fatal().Msgf("KVServer %v: snapshot: %v", kv.me, err)
+	}
+	kv.paxos.Snapshot(kv.lastApplied, w.Bytes())
+}
+
+// Must hold kv.mu.
+func (kv *KVServer) readSnapshot(snapshot []byte) {
+	data := make(map[string]string)
+	if len(snapshot) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(snapshot)).Decode(&data); err != nil {
+			log.Fatal().Msgf("KVServer %v: readSnapshot: %v", kv.me, err)
+		}
+	}
+	kv.data = data
+}
+
+// Kill stops the server and its OmniPaxos instance
+func (kv *KVServer) Kill() {
+	atomic.StoreInt32(&kv.dead, 1)
+	kv.paxos.Kill()
+}
+
+func (kv *KVServer) killed() bool {
+	z := atomic.LoadInt32(&kv.dead)
+	return z == 1
+}
+
+// StartKVServer starts the key/value server and its OmniPaxos instance.
+// servers[] holds the ports of the servers, which serve both; me is the
+// index of this one. The server snapshots when the state OmniPaxos
+// persists grows past maxpaxosstate bytes, or never if it is -1. A
+// restarted server recovers its data from the snapshot and the log in
+// persister. StartKVServer returns quickly; the work happens in
+// goroutines.
+func StartKVServer(servers []*labrpc.ClientEnd, me int, persister *omnipaxos.Persister, maxpaxosstate int) *KVServer {
+	kv := new(KVServer)
+	kv.me = me
+	kv.maxpaxosstate = maxpaxosstate
+	kv.persister = persister
+	kv.data = make(map[string]string)
+	kv.lastApplied = -1
+	kv.waiting = make(map[int]chan applied)
+
+	kv.applyCh = make(chan omnipaxos.ApplyMsg)
+	kv.paxos = omnipaxos.Make(servers, me, persister, kv.applyCh)
+
+	go kv.applier()
+	return kv
+}
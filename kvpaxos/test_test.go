@@ -0,0 +1,541 @@
+package kvpaxos
+
+//
+// kvpaxos tests.
+//
+// You can run the tester with the following flags in addition to the
+// standard ones provided by `go test`:
+// 	-pretty (this will enable pretty printing)
+// 	-loglevel [n] (this will set the log level accordingly)
+
+import (
+	"flag"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"omnipaxos"
+)
+
+var prettyPrint bool
+var logLevel int
+
+func init() {
+	flag.BoolVar(&prettyPrint, "pretty", true, "Enable pretty printing for zerolog")
+	flag.IntVar(&logLevel, "loglevel", 1, "Set the log level for zerolog (-1=trace, 0=debug, 1=info, 2=warn, 3=error, 4=fatal, 5=panic)")
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	omnipaxos.SetupLogger(logLevel, prettyPrint)
+	os.Exit(m.Run())
+}
+
+// The tester generously allows solutions to complete elections in one second
+// (much more than the paper's range of timeouts).
+const electionTimeout = 1 * time.Second
+
+// how long the clients of each iteration of GenericTest run
+const clientTime = 3 * time.Second
+
+// history records what the clerks asked and got, for the
+// linearizability check
+type history struct {
+	mu  sync.Mutex
+	t0  time.Time
+	ops []Operation
+}
+
+func (h *history) now() int64 {
+	return time.Since(h.t0).Nanoseconds()
+}
+
+func (h *history) add(op Operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+// Get/Put/Append through a clerk, counted by the tester and recorded in
+// the history
+func Get(cfg *config, ck *Clerk, key string, h *history) string {
+	call := h.now()
+	v := ck.Get(key)
+	h.add(Operation{Op: "Get", Key: key, Output: v, Call: call, Return: h.now()})
+	cfg.op()
+	return v
+}
+
+func Put(cfg *config, ck *Clerk, key string, value string, h *history) {
+	call := h.now()
+	ck.Put(key, value)
+	h.add(Operation{Op: "Put", Key: key, Value: value, Call: call, Return: h.now()})
+	cfg.op()
+}
+
+func Append(cfg *config, ck *Clerk, key string, value string, h *history) {
+	call := h.now()
+	ck.Append(key, value)
+	h.add(Operation{Op: "Append", Key: key, Value: value, Call: call, Return: h.now()})
+	cfg.op()
+}
+
+func check(cfg *config, t *testing.T, ck *Clerk, key string, value string, h *history) {
+	v := Get(cfg, ck, key, h)
+	if v != value {
+		t.Fatalf("Get(%v): expected:\n%v\nreceived:\n%v", key, value, v)
+	}
+}
+
+func checkLinearizable(t *testing.T, h *history) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ok, key := CheckLinearizable(h.ops); !ok {
+		t.Fatalf("history is not linearizable at key %q", key)
+	}
+}
+
+// spawn ncli clients; wait_clients waits until they are all done
+func spawn_clients(cfg *config, ncli int, fn func(me int, ck *Clerk)) []chan bool {
+	ca := make([]chan bool, ncli)
+	for cli := 0; cli < ncli; cli++ {
+		ca[cli] = make(chan bool, 1)
+		go func(cli int) {
+			ok := false
+			defer func() { ca[cli] <- ok }()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			fn(cli, ck)
+			ok = true
+		}(cli)
+	}
+	return ca
+}
+
+func wait_clients(t *testing.T, ca []chan bool) {
+	for cli := range ca {
+		if ok := <-ca[cli]; !ok {
+			t.Fatalf("client %v failed", cli)
+		}
+	}
+}
+
+// check that each client's appends, "x cli j y", are all present in
+// values, exactly once, and in order within each value
+func checkClntAppends(t *testing.T, values []string, counts []int) {
+	seen := make([]map[int]bool, len(counts))
+	for cli := range seen {
+		seen[cli] = make(map[int]bool)
+	}
+	for _, v := range values {
+		fields := strings.Fields(v)
+		if len(fields)%4 != 0 {
+			t.Fatalf("malformed Append result %q", v)
+		}
+		last := make([]int, len(counts))
+		for cli := range last {
+			last[cli] = -1
+		}
+		for i := 0; i < len(fields); i += 4 {
+			cli, err1 := strconv.Atoi(fields[i+1])
+			j, err2 := strconv.Atoi(fields[i+2])
+			if fields[i] != "x" || fields[i+3] != "y" || err1 != nil || err2 != nil || cli < 0 || cli >= len(counts) {
+				t.Fatalf("malformed Append result %q", v)
+			}
+			if seen[cli][j] {
+				t.Fatalf("duplicate element x %v %v y in Append result", cli, j)
+			}
+			if j <= last[cli] {
+				t.Fatalf("wrong order for element x %v %v y in Append result", cli, j)
+			}
+			seen[cli][j] = true
+			last[cli] = j
+		}
+	}
+	for cli, count := range counts {
+		if len(seen[cli]) != count {
+			t.Fatalf("client %v made %v appends but %v are present", cli, count, len(seen[cli]))
+		}
+	}
+}
+
+// repartition the servers periodically
+func partitioner(t *testing.T, cfg *config, ch chan bool, done *int32) {
+	defer func() { ch <- true }()
+	for atomic.LoadInt32(done) == 0 {
+		a := make([]int, cfg.n)
+		for i := 0; i < cfg.n; i++ {
+			a[i] = rand.Int() % 2
+		}
+		pa := make([][]int, 2)
+		for i := 0; i < 2; i++ {
+			pa[i] = make([]int, 0)
+			for j := 0; j < cfg.n; j++ {
+				if a[j] == i {
+					pa[i] = append(pa[i], j)
+				}
+			}
+		}
+		cfg.partition(pa[0], pa[1])
+		time.Sleep(electionTimeout + time.Duration(rand.Int63()%200)*time.Millisecond)
+	}
+}
+
+// Basic test is as follows: one or more clients submitting Append/Get
+// operations to a random key among the clients' keys, for a few seconds.
+// At the end of each iteration every client's appends must be present in
+// order, exactly once, and the whole history must be linearizable. If
+// unreliable is set, RPCs may fail. If crash is set, the servers crash
+// after the clients stop, and re-start. If partitions is set, the test
+// repartitions the network concurrently with the clients. If
+// maxpaxosstate is a positive number, the size of the state for OmniPaxos
+// shouldn't exceed 8*maxpaxosstate; if it is -1, nobody snapshots.
+func GenericTest(t *testing.T, part string, nclients int, unreliable bool, crash bool, partitions bool, maxpaxosstate int) {
+	title := "Test (" + part + "): "
+	if unreliable {
+		title = title + "unreliable net, "
+	}
+	if crash {
+		title = title + "restarts, "
+	}
+	if partitions {
+		title = title + "partitions, "
+	}
+	if maxpaxosstate != -1 {
+		title = title + "snapshots, "
+	}
+	if nclients > 1 {
+		title = title + "many clients"
+	} else {
+		title = title + "one client"
+	}
+
+	const nservers = 5
+	cfg := makeConfig(t, nservers, unreliable, maxpaxosstate)
+	defer cfg.cleanup()
+
+	cfg.begin(title)
+	h := &history{t0: time.Now()}
+
+	ck := cfg.makeClient(cfg.All())
+
+	done_partitioner := int32(0)
+	done_clients := int32(0)
+	ch_partitioner := make(chan bool)
+	counts := make([]int, nclients) // appends done by each client
+	for i := 0; i < 3; i++ {
+		atomic.StoreInt32(&done_clients, 0)
+		atomic.StoreInt32(&done_partitioner, 0)
+		clnts := spawn_clients(cfg, nclients, func(cli int, myck *Clerk) {
+			for atomic.LoadInt32(&done_clients) == 0 {
+				key := strconv.Itoa(rand.Int() % nclients)
+				if (rand.Int() % 1000) < 500 {
+					nv := "x " + strconv.Itoa(cli) + " " + strconv.Itoa(counts[cli]) + " y "
+					Append(cfg, myck, key, nv, h)
+					counts[cli]++
+				} else {
+					Get(cfg, myck, key, h)
+				}
+			}
+		})
+
+		if partitions {
+			// allow the clients to perform some operations without
+			// interruption
+			time.Sleep(1 * time.Second)
+			go partitioner(t, cfg, ch_partitioner, &done_partitioner)
+		}
+		time.Sleep(clientTime)
+
+		atomic.StoreInt32(&done_clients, 1)     // tell clients to quit
+		atomic.StoreInt32(&done_partitioner, 1) // tell partitioner to quit
+
+		if partitions {
+			<-ch_partitioner
+			// reconnect network and submit a request. A client may have
+			// submitted a request in a minority; that request won't return
+			// until that server discovers a new ballot has started.
+			cfg.ConnectAll()
+			// wait for a while so that we have a new ballot
+			time.Sleep(electionTimeout)
+		}
+
+		wait_clients(t, clnts)
+
+		if crash {
+			for i := 0; i < nservers; i++ {
+				cfg.ShutdownServer(i)
+			}
+			// wait for a while so that servers really shut down
+			time.Sleep(electionTimeout)
+			for i := 0; i < nservers; i++ {
+				cfg.StartServer(i)
+			}
+			cfg.ConnectAll()
+		}
+
+		values := make([]string, nclients)
+		for key := 0; key < nclients; key++ {
+			values[key] = Get(cfg, ck, strconv.Itoa(key), h)
+		}
+		checkClntAppends(t, values, counts)
+
+		if maxpaxosstate > 0 {
+			// Check maximum after the servers have processed all client
+			// requests and had time to checkpoint.
+			sz := cfg.LogSize()
+			if sz > 8*maxpaxosstate {
+				t.Fatalf("logs were not trimmed (%v > 8*%v)", sz, maxpaxosstate)
+			}
+		}
+		if maxpaxosstate < 0 {
+			// Check that snapshots are not used
+			ssz := cfg.SnapshotSize()
+			if ssz > 0 {
+				t.Fatalf("snapshot too large (%v), should not be used when maxpaxosstate = %d", ssz, maxpaxosstate)
+			}
+		}
+	}
+
+	checkLinearizable(t, h)
+	cfg.end()
+}
+
+func TestBasic8(t *testing.T) {
+	// Test: one client (8).
+	GenericTest(t, "8", 1, false, false, false, -1)
+}
+
+func TestConcurrent8(t *testing.T) {
+	// Test: many clients (8).
+	GenericTest(t, "8", 5, false, false, false, -1)
+}
+
+func TestUnreliable8(t *testing.T) {
+	// Test: unreliable net, many clients (8).
+	GenericTest(t, "8", 5, true, false, false, -1)
+}
+
+func TestPutGetAppend8(t *testing.T) {
+	const nservers = 3
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (8): [TestPutGetAppend8] Put, Get and Append on one client")
+	h := &history{t0: time.Now()}
+	ck := cfg.makeClient(cfg.All())
+
+	check(cfg, t, ck, "a", "", h)
+	Put(cfg, ck, "a", "1", h)
+	check(cfg, t, ck, "a", "1", h)
+	Append(cfg, ck, "a", "2", h)
+	Append(cfg, ck, "b", "3", h)
+	check(cfg, t, ck, "a", "12", h)
+	check(cfg, t, ck, "b", "3", h)
+	Put(cfg, ck, "a", "4", h)
+	check(cfg, t, ck, "a", "4", h)
+
+	checkLinearizable(t, h)
+	cfg.end()
+}
+
+// Clerks retrying over a network that drops requests and replies must
+// not have their appends applied twice.
+func TestUnreliableOneKey8(t *testing.T) {
+	const nservers = 3
+	cfg := makeConfig(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (8): [TestUnreliableOneKey8] concurrent append to same key, unreliable")
+	h := &history{t0: time.Now()}
+	ck := cfg.makeClient(cfg.All())
+
+	Put(cfg, ck, "k", "", h)
+
+	const nclient = 5
+	const upto = 10
+	wait_clients(t, spawn_clients(cfg, nclient, func(me int, myck *Clerk) {
+		for n := 0; n < upto; n++ {
+			Append(cfg, myck, "k", "x "+strconv.Itoa(me)+" "+strconv.Itoa(n)+" y ", h)
+		}
+	}))
+
+	counts := make([]int, nclient)
+	for i := range counts {
+		counts[i] = upto
+	}
+	checkClntAppends(t, []string{Get(cfg, ck, "k", h)}, counts)
+
+	checkLinearizable(t, h)
+	cfg.end()
+}
+
+// Submit a request in the minority partition and check that the requests
+// doesn't go through until the partition heals. The leader in the
+// original network ends up in the minority partition.
+func TestOnePartition8(t *testing.T) {
+	const nservers = 5
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+	h := &history{t0: time.Now()}
+	ck := cfg.makeClient(cfg.All())
+
+	Put(cfg, ck, "1", "13", h)
+
+	cfg.begin("Test (8): [TestOnePartition8] progress in majority")
+
+	p1, p2 := cfg.make_partition()
+	cfg.partition(p1, p2)
+
+	ckp1 := cfg.makeClient(p1)  // connect ckp1 to p1
+	ckp2a := cfg.makeClient(p2) // connect ckp2a to p2
+	ckp2b := cfg.makeClient(p2) // connect ckp2b to p2
+
+	Put(cfg, ckp1, "1", "14", h)
+	check(cfg, t, ckp1, "1", "14", h)
+
+	cfg.end()
+
+	done0 := make(chan bool)
+	done1 := make(chan bool)
+
+	cfg.begin("Test (8): [TestOnePartition8] no progress in minority")
+	go func() {
+		Put(cfg, ckp2a, "1", "15", h)
+		done0 <- true
+	}()
+	go func() {
+		Get(cfg, ckp2b, "1", h) // different clerk in p2
+		done1 <- true
+	}()
+
+	select {
+	case <-done0:
+		t.Fatalf("Put in minority completed")
+	case <-done1:
+		t.Fatalf("Get in minority completed")
+	case <-time.After(time.Second):
+	}
+
+	check(cfg, t, ckp1, "1", "14", h)
+	Put(cfg, ckp1, "1", "16", h)
+	check(cfg, t, ckp1, "1", "16", h)
+
+	cfg.end()
+
+	cfg.begin("Test (8): [TestOnePartition8] completion after heal")
+
+	cfg.ConnectAll()
+	cfg.ConnectClient(ckp2a, cfg.All())
+	cfg.ConnectClient(ckp2b, cfg.All())
+
+	time.Sleep(electionTimeout)
+
+	select {
+	case <-done0:
+	case <-time.After(30 * 100 * time.Millisecond):
+		t.Fatalf("Put did not complete")
+	}
+
+	select {
+	case <-done1:
+	case <-time.After(30 * 100 * time.Millisecond):
+		t.Fatalf("Get did not complete")
+	}
+
+	check(cfg, t, ck, "1", "15", h)
+
+	checkLinearizable(t, h)
+	cfg.end()
+}
+
+func TestManyPartitionsManyClients8(t *testing.T) {
+	// Test: partitions, many clients (8).
+	GenericTest(t, "8", 5, false, false, true, -1)
+}
+
+func TestPersistConcurrent8(t *testing.T) {
+	// Test: restarts, many clients (8).
+	GenericTest(t, "8", 5, false, true, false, -1)
+}
+
+func TestPersistPartitionUnreliable8(t *testing.T) {
+	// Test: unreliable net, restarts, partitions, many clients (8).
+	GenericTest(t, "8", 5, true, true, true, -1)
+}
+
+// Snapshots keep the state OmniPaxos persists small.
+func TestSnapshotSize8(t *testing.T) {
+	const nservers = 3
+	const maxpaxosstate = 1000
+	cfg := makeConfig(t, nservers, false, maxpaxosstate)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (8): [TestSnapshotSize8] snapshot size is reasonable")
+	h := &history{t0: time.Now()}
+	ck := cfg.makeClient(cfg.All())
+
+	for i := 0; i < 200; i++ {
+		Put(cfg, ck, "x", "0", h)
+		check(cfg, t, ck, "x", "0", h)
+		Put(cfg, ck, "x", "1", h)
+		check(cfg, t, ck, "x", "1", h)
+	}
+
+	// check that OmniPaxos's state isn't too large
+	if sz := cfg.LogSize(); sz > 8*maxpaxosstate {
+		t.Fatalf("logs were not trimmed (%v > 8*%v)", sz, maxpaxosstate)
+	}
+	if sz := cfg.SnapshotSize(); sz > 500 {
+		t.Fatalf("snapshot too large (%v > 500)", sz)
+	}
+
+	checkLinearizable(t, h)
+	cfg.end()
+}
+
+func TestSnapshotRecover8(t *testing.T) {
+	// Test: restarts, snapshots, one client (8).
+	GenericTest(t, "8", 1, false, true, false, 1000)
+}
+
+func TestSnapshotUnreliableRecoverPartitions8(t *testing.T) {
+	// Test: unreliable net, restarts, partitions, snapshots, many clients (8).
+	GenericTest(t, "8", 5, true, true, true, 1000)
+}
+
+// The checker itself must reject a Get that saw a write that had not
+// happened yet, or missed one that had finished.
+func TestCheckerRejects8(t *testing.T) {
+	ok := []Operation{
+		{Op: "Put", Key: "k", Value: "1", Call: 0, Return: 10},
+		{Op: "Get", Key: "k", Output: "1", Call: 5, Return: 15},
+		{Op: "Append", Key: "k", Value: "2", Call: 12, Return: 20},
+		{Op: "Get", Key: "k", Output: "1", Call: 14, Return: 16},
+		{Op: "Get", Key: "k", Output: "12", Call: 18, Return: 30},
+	}
+	if linearizable, key := CheckLinearizable(ok); !linearizable {
+		t.Fatalf("linearizable history rejected at key %q", key)
+	}
+
+	stale := []Operation{
+		{Op: "Put", Key: "k", Value: "1", Call: 0, Return: 10},
+		{Op: "Get", Key: "k", Output: "", Call: 11, Return: 12},
+	}
+	if linearizable, _ := CheckLinearizable(stale); linearizable {
+		t.Fatalf("stale read accepted")
+	}
+
+	early := []Operation{
+		{Op: "Get", Key: "k", Output: "1", Call: 0, Return: 5},
+		{Op: "Put", Key: "k", Value: "1", Call: 6, Return: 10},
+	}
+	if linearizable, _ := CheckLinearizable(early); linearizable {
+		t.Fatalf("read from the future accepted")
+	}
+}
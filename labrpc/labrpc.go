@@ -129,12 +129,13 @@ type CallbackFunc func(string, interface{})
 type Network struct {
 	mu             sync.Mutex
 	reliable       bool
-	longDelays     bool                        // pause a long time on send on disabled connection
-	longReordering bool                        // sometimes delay replies a long time
-	ends           map[interface{}]*ClientEnd  // ends, by name
-	enabled        map[interface{}]bool        // by end name
-	servers        map[interface{}]*Server     // servers, by name
-	connections    map[interface{}]interface{} // endname -> servername
+	longDelays     bool                          // pause a long time on send on disabled connection
+	longReordering bool                          // sometimes delay replies a long time
+	ends           map[interface{}]*ClientEnd    // ends, by name
+	enabled        map[interface{}]bool          // by end name
+	servers        map[interface{}]*Server       // servers, by name
+	connections    map[interface{}]interface{}   // endname -> servername
+	latency        map[interface{}]time.Duration // extra delay on requests, by server name
 	endCh          chan reqMsg
 	done           chan struct{} // closed when Network is cleaned up
 	count          int32         // total RPC count, for statistics
@@ -149,6 +150,7 @@ func MakeNetwork() *Network {
 	rn.enabled = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.latency = map[interface{}]time.Duration{}
 	rn.endCh = make(chan reqMsg)
 	rn.done = make(chan struct{})
 
@@ -201,6 +203,21 @@ func (rn *Network) LongDelays(yes bool) {
 	rn.longDelays = yes
 }
 
+// Latency delays every request to a server by d, as a slow link would.
+func (rn *Network) Latency(servername interface{}, d time.Duration) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.latency[servername] = d
+}
+
+func (rn *Network) readLatency(servername interface{}) time.Duration {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.latency[servername]
+}
+
 func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
 	servername interface{}, server *Server, reliable bool, longreordering bool,
 ) {
@@ -246,6 +263,10 @@ func (rn *Network) processReq(req reqMsg) {
 			time.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
+		if d := rn.readLatency(servername); d > 0 {
+			time.Sleep(d)
+		}
+
 		if reliable == false && (rand.Int()%1000) < 100 {
 			// drop the request, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
@@ -2,6 +2,7 @@ package omnipaxos
 
 import (
 	"math"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -28,7 +29,7 @@ type PrepareRequest struct {
 
 // checkLeader must be called while holding op.mu
 func (op *OmniPaxos) checkLeader() {
-	max := BallotNumber{math.MinInt, math.MinInt}
+	max := BallotNumber{math.MinInt, math.MinInt, math.MinInt}
 	for _, ballot := range op.ballots {
 		if !ballot.Qc {
 			continue
@@ -38,42 +39,86 @@ func (op *OmniPaxos) checkLeader() {
 		}
 	}
 
+	op.leaderAlive = max.Compare(op.L) >= 0
+	if op.leaderAlive {
+		op.missedLeaderRnds = 0
+	} else {
+		op.missedLeaderRnds++
+	}
+
 	switch (max).Compare(op.L) {
 	case -1:
-		// start new election
-		log.Info().Msgf("checkLeader(%v): inc(l), qc = true", op.R)
-		op.B = BallotNumber{op.L.Value + 1, op.B.Pid}
-		op.qc = true
+		// start new election, once a majority would follow us (see
+		// prevote.go)
+		log.Info().Msgf("checkLeader(%v): pre-vote for inc(l)", op.R)
+		op.preVote(BallotNumber{op.L.Value + 1, op.B.Priority, op.B.Pid})
+	case 0:
+		// we are quorum-connected, and take over from a leader we are
+		// preferred to
+		if op.L.Pid != op.me && op.B.Priority > op.L.Priority {
+			log.Info().Msgf("checkLeader(%v): taking over from %v", op.R, op.L)
+			op.B = BallotNumber{op.L.Value + 1, op.B.Priority, op.B.Pid}
+			op.bleStats.BallotIncrements++
+			op.qc = true
+			op.persist()
+		}
 	case 1:
 		op.L = max
-		go func() {
-			op.serializeCh <- struct{}{}        // acquire semaphore
-			defer func() { <-op.serializeCh }() // release
-			op.leaderFromBLE(max.Pid, max)
-		}()
+		go op.leaderFromBLE(max.Pid, max)
 	}
 }
 
+// SetPriority sets this server's leader priority, 0 by default. The
+// priority is part of our ballot, between its value and the pid, so BLE
+// elects the quorum-connected server with the highest priority among
+// ballots of the same value, and a server with a higher priority than the
+// leader raises its ballot to take over. Priorities are not persisted;
+// call it again after a restart.
+func (op *OmniPaxos) SetPriority(priority int) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.B.Priority = priority
+}
+
 // method to initialize all states for Ballot Election Algorithm(Figure 3.2)
 func (op *OmniPaxos) leaderFromBLE(s int, n BallotNumber) {
 	op.mu.Lock()
 	defer op.mu.Unlock()
 
 	if s == op.me && n.Compare(op.promisedRnd) == 1 {
+		// our own promise counts too, so it waits for the lease we granted
+		// another leader to run out
+		if wait := op.leaseWait(n); wait > 0 {
+			time.AfterFunc(wait, func() {
+				op.mu.Lock()
+				elected := op.L == n
+				op.mu.Unlock()
+				if elected {
+					op.leaderFromBLE(s, n)
+				}
+			})
+			return
+		}
+
 		// Reset all volatile state of leader (per paper)
 		op.promises = make(map[int]Promise)
 		op.maxProm = Promise{}
-		op.accepted = make([]int, len(op.peers))
-		op.buffer = make([]any, 0)
+		op.accepted = make([]int, op.npeers)
+		op.dropBuffered(ErrLeaderChanged)
 
 		// become da leader!
 		op.role = LEADER
 		op.phase = PREPARE
 		op.currentRnd = n
 		op.promisedRnd = n
+		// drop anything past a hole left by an out-of-order accept
+		op.log = op.prefix(op.receivedLen())
+		op.persist()
 
-		// TODO : decided suffix?
-		next := Promise{op.acceptedRnd, len(op.log), op.me, op.decidedIdx, op.suffix(op.decidedIdx)}
+		// the leader already holds its own log, so its promise carries an
+		// empty suffix; P4 would otherwise append its entries twice
+		next := Promise{op.acceptedRnd, op.logLen(), op.me, op.decidedIdx, op.suffix(op.logLen()), nil, 0, nil}
 		op.promises[op.me] = next
 
 		log.Info().Msgf("Server %v became leader with ballot %v", op.me, n)
@@ -82,28 +127,30 @@ func (op *OmniPaxos) leaderFromBLE(s int, n BallotNumber) {
 		// send⟨Prepare, currentRnd, acceptedRnd, |log|, decidedIdx⟩ to all peers
 
 		// wg := sync.WaitGroup{}
-		// Capture values before spawning goroutines to avoid races
-		round := op.R
-
-		for i, peer := range op.peers {
+		for i := range op.npeers {
 			if i == op.me {
 				continue
 			}
-			i, peer := i, peer
 			// send⟨Prepare, currentRnd, acceptedRnd, |log|, decidedIdx⟩ to all peers
-			prepare_request := PrepareRequest{op.me, op.currentRnd, op.acceptedRnd, len(op.log), op.decidedIdx}
-
-			go func() {
-				op.serializeCh <- struct{}{}        // acquire semaphore
-				defer func() { <-op.serializeCh }() // release
-				if !peer.Call("OmniPaxos.RecievePrepare", &prepare_request, &DummyReply{}) {
-					log.Info().Msgf("checkLeader(%v): no response from %v", round, i)
-					return
-				}
-			}()
+			op.send(i, &PrepareRequest{op.me, op.currentRnd, op.acceptedRnd, op.logLen(), op.decidedIdx})
 		}
 
 	} else {
+		if s == op.me {
+			// elected with a ballot we have already promised away (e.g.
+			// before a crash); raise it so the next round elects us with
+			// a ballot the followers can promise to
+			op.B = BallotNumber{max(op.B.Value, op.promisedRnd.Value) + 1, op.B.Priority, op.me}
+			op.bleStats.BallotIncrements++
+			op.persist()
+		} else if n.Compare(op.promisedRnd) == 1 && (op.role == LEADER || op.phase == PREPARE) {
+			// deposed while partitioned: the new leader's Prepare was
+			// lost, and a leader never notices its own link drop. Or we
+			// promised a ballot that lost to n, and its leader will never
+			// synchronize us.
+			op.phase = RECOVER
+			op.sendPrepareRecoveringFollower(s)
+		}
 		op.role = FOLLOWER
 	}
 }
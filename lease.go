@@ -0,0 +1,67 @@
+package omnipaxos
+
+import (
+	"time"
+)
+
+// Leader leases. A follower that acknowledges a heartbeat from the leader
+// it has promised grants that ballot a lease: for Config.LeaseDuration it does
+// not promise any other ballot, deferring such Prepares until the lease
+// runs out. Without a majority of promises a new leader cannot decide
+// anything, so a leader that a majority has granted a lease can serve
+// reads from its own state until the lease expires.
+//
+// Every server measures lease time on its own clock. The leader counts its
+// lease from when it sent the heartbeat, and shortens it so that it ends
+// first as long as no clock runs more than maxClockDrift faster or slower
+// than real time.
+
+// default for Config.LeaseDuration
+const leaseDuration = 250 * time.Millisecond
+
+const maxClockDrift = 0.05
+
+// leaderLease is how long a leader may rely on a lease measured on its
+// own clock
+func (op *OmniPaxos) leaderLease() time.Duration {
+	d := float64(op.config.LeaseDuration)
+	return time.Duration(d * (1 - maxClockDrift) / (1 + maxClockDrift))
+}
+
+// grantLease is called when a heartbeat from the accepting leader of
+// ballot n arrives, and returns whether the lease was granted.
+// Must hold op.mu.
+func (op *OmniPaxos) grantLease(n BallotNumber) bool {
+	if op.promisedRnd != n || op.role != FOLLOWER || op.distrusts(n) {
+		return false
+	}
+	op.leaseRnd = n
+	op.leaseUntil = op.clock().Add(op.config.LeaseDuration)
+	return true
+}
+
+// leaseWait returns how long we must wait before we can promise ballot
+// n without breaking a lease we granted. Must hold op.mu.
+func (op *OmniPaxos) leaseWait(n BallotNumber) time.Duration {
+	if n == op.leaseRnd {
+		return 0
+	}
+	return max(op.leaseUntil.Sub(op.clock()), 0)
+}
+
+// LeaseRead is ReadIndex without the round trip to a majority: it returns
+// the index of the last entry a linearizable read must observe, and
+// whether this server could serve it because it holds a leader lease.
+// As with ReadIndex, the service reads once it has applied the entry.
+func (op *OmniPaxos) LeaseRead() (int, bool) {
+	op.mu.Lock()
+	if op.role != LEADER || op.phase != ACCEPT || op.leaseRnd != op.currentRnd || !op.clock().Before(op.leaseUntil) {
+		op.mu.Unlock()
+		return -1, false
+	}
+	n := op.currentRnd
+	readIdx := op.logLen()
+	op.mu.Unlock()
+
+	return op.waitDecided(n, readIdx)
+}
@@ -0,0 +1,140 @@
+package omnipaxos
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LocalNetwork connects servers in the same process through Transports
+// that call the peer's handlers directly. Arguments are copied on the
+// way, as a real network would, so that no server holds on to memory
+// another one still uses. Servers can be disconnected and reconnected.
+type LocalNetwork struct {
+	mu        sync.Mutex
+	servers   []*OmniPaxos
+	connected []bool
+}
+
+func NewLocalNetwork(n int) *LocalNetwork {
+	return &LocalNetwork{
+		servers:   make([]*OmniPaxos, n),
+		connected: make([]bool, n),
+	}
+}
+
+// Transport returns the transport server me sends through
+func (ln *LocalNetwork) Transport(me int) Transport {
+	return &localTransport{ln, me}
+}
+
+// Register makes op reachable as server me, and connects it
+func (ln *LocalNetwork) Register(me int, op *OmniPaxos) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.servers[me] = op
+	ln.connected[me] = true
+}
+
+// Connect attaches server i to the network, or detaches it: messages to
+// and from a detached server are lost.
+func (ln *LocalNetwork) Connect(i int, connected bool) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.connected[i] = connected
+}
+
+// peer returns the server to deliver from's message to, or nil if the
+// message is lost, including when no server is registered as to
+func (ln *LocalNetwork) peer(from int, to int) *OmniPaxos {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if !ln.connected[from] || !ln.connected[to] || ln.servers[to] == nil || ln.servers[to].killed() {
+		return nil
+	}
+	return ln.servers[to]
+}
+
+type localTransport struct {
+	net *LocalNetwork
+	me  int
+}
+
+// localCall hands a copy of args to the handler of server peer
+func localCall[A any, R any](t *localTransport, peer int, args *A, reply *R, handler func(*OmniPaxos, *A, *R)) bool {
+	op := t.net.peer(t.me, peer)
+	if op == nil {
+		return false
+	}
+	var buf bytes.Buffer
+	copied := new(A)
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		log.Error().Msgf("LocalNetwork: cannot encode %T: %v", args, err)
+		return false
+	}
+	if err := gob.NewDecoder(&buf).Decode(copied); err != nil {
+		log.Error().Msgf("LocalNetwork: cannot decode %T: %v", args, err)
+		return false
+	}
+	handler(op, copied, reply)
+	// a reply to a server that went away meanwhile is lost too
+	return t.net.peer(t.me, peer) != nil
+}
+
+func (t *localTransport) Peers() int {
+	return len(t.net.servers)
+}
+
+func (t *localTransport) Prepare(peer int, args *PrepareRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).RecievePrepare)
+}
+
+func (t *localTransport) Promise(peer int, args *PromiseFromFollowerRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).PromiseFromFollower)
+}
+
+func (t *localTransport) AcceptSync(peer int, args *AcceptSyncFromLeaderRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).AcceptSyncFromLeader)
+}
+
+func (t *localTransport) SyncChunk(peer int, args *SyncChunkFromLeaderRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).SyncChunkFromLeader)
+}
+
+func (t *localTransport) Accept(peer int, args *AcceptFromLeaderRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).AcceptFromLeader)
+}
+
+func (t *localTransport) Accepted(peer int, args *AcceptedFromFollowerRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).AcceptedFromFollower)
+}
+
+func (t *localTransport) Decide(peer int, args *DecideFromLeaderRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).DecideFromLeader)
+}
+
+func (t *localTransport) PrepareRecoveringFollower(peer int, args *PrepareRecoveringFollowerRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).PrepareRecoveringFollower)
+}
+
+func (t *localTransport) TakeLeadership(peer int, args *TakeLeadershipRequest) bool {
+	return localCall(t, peer, args, &DummyReply{}, (*OmniPaxos).TakeLeadership)
+}
+
+func (t *localTransport) HB(peer int, args *HBRequest, reply *HBReply) bool {
+	return localCall(t, peer, args, reply, (*OmniPaxos).ReceiveHBRequest)
+}
+
+func (t *localTransport) PreVote(peer int, args *PreVoteRequest, reply *PreVoteReply) bool {
+	return localCall(t, peer, args, reply, (*OmniPaxos).PreVote)
+}
+
+func (t *localTransport) ConfirmLeader(peer int, args *ConfirmLeaderRequest, reply *ConfirmLeaderReply) bool {
+	return localCall(t, peer, args, reply, (*OmniPaxos).ConfirmLeader)
+}
+
+func (t *localTransport) ForwardProposal(peer int, args *ForwardProposalRequest, reply *ForwardProposalReply) bool {
+	return localCall(t, peer, args, reply, (*OmniPaxos).ForwardProposal)
+}
@@ -0,0 +1,83 @@
+package omnipaxos
+
+import "encoding/gob"
+
+// Key-based log cleaning (as in Kafka's log compaction). When most
+// commands overwrite a key, only the latest decided entry per key matters.
+// The service supplies a function naming the key a command affects, and
+// every cleanEveryRounds rounds OmniPaxos replaces decided entries that a
+// later decided entry has superseded with a small placeholder. Indices do
+// not change, so replicas and catch-up work as before; the placeholders
+// are applied as ApplyMsgs with CommandValid false.
+
+const cleanEveryRounds = 10
+
+// KeyFunc returns the key a command affects, or false if the command
+// must never be cleaned. A later entry with the same key must fully
+// overwrite the earlier one's effect, as a Put does: the earlier entry is
+// never applied by a server that catches up after it was cleaned, so a
+// command whose effect merges with the key's value, like an append or an
+// increment, must return false.
+type KeyFunc func(command any) (string, bool)
+
+// cleaned replaces a log entry superseded by the entry at By. A cleaned
+// session command keeps its client and Seq, so retries of it are still
+// recognized as duplicates.
+type cleaned struct {
+	By       int
+	ClientID int64
+	Seq      int64
+}
+
+func init() {
+	gob.Register(cleaned{})
+}
+
+func isCleaned(entry any) bool {
+	_, ok := entry.(cleaned)
+	return ok
+}
+
+// SetKeyFunc turns on log cleaning with keyOf, or turns it off if keyOf
+// is nil. Cleaning state is not persisted; call it again after a restart.
+func (op *OmniPaxos) SetKeyFunc(keyOf KeyFunc) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.keyOf = keyOf
+	op.cleanedIdx = 0
+	op.latest = make(map[string]int)
+}
+
+// cleanLog cleans the applied entries it has not looked at yet. Entries
+// the applier has yet to deliver are left alone, so the service sees each
+// of them before it is superseded. Must hold op.mu.
+func (op *OmniPaxos) cleanLog() {
+	if op.keyOf == nil {
+		return
+	}
+	// entries before the log were compacted; whatever they superseded
+	// is gone with them
+	start := max(op.cleanedIdx, op.compactedIdx)
+	changed := false
+	for i := start; i < op.appliedIdx && i < op.logLen(); i++ {
+		entry := op.log[i-op.compactedIdx]
+		if entry == nil || isCleaned(entry) || isStopSign(entry) {
+			continue
+		}
+		key, ok := op.keyOf(entry)
+		if !ok {
+			continue
+		}
+		if prev, ok := op.latest[key]; ok && prev >= op.compactedIdx && !isCleaned(op.log[prev-op.compactedIdx]) {
+			id, seq, _ := sessionOf(op.log[prev-op.compactedIdx])
+			op.log[prev-op.compactedIdx] = cleaned{i, id, seq}
+			changed = true
+		}
+		op.latest[key] = i
+	}
+	op.cleanedIdx = max(start, min(op.appliedIdx, op.logLen()))
+	if changed {
+		op.persist()
+	}
+}
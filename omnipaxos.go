@@ -11,13 +11,17 @@ package omnipaxos
 //   Start agreement on a new log entry
 // op.GetState() (ballot, isLeader)
 //   ask a OmniPaxos for its current ballot, and whether it thinks it is leader
+// op.Snapshot(index, snapshot)
+//   the service has snapshotted its state up to and including index
 // ApplyMsg
 //   Each time a new entry is committed to the log, each OmniPaxos peer
 //   should send an ApplyMsg to the service (or tester) in the same server.
 //
 
 import (
+	"bytes"
 	"cmp"
+	"encoding/gob"
 	"omnipaxos/labrpc"
 	"sync"
 	"sync/atomic"
@@ -38,14 +42,16 @@ const (
 )
 
 type BallotNumber struct {
-	Value int
-	Pid   int
+	Value    int
+	Priority int // see SetPriority
+	Pid      int
 }
 
 // lexicographic comparison
 func (bn BallotNumber) Compare(other BallotNumber) int {
 	return cmp.Or(
 		cmp.Compare(bn.Value, other.Value),
+		cmp.Compare(bn.Priority, other.Priority),
 		cmp.Compare(bn.Pid, other.Pid),
 	)
 }
@@ -69,13 +75,21 @@ type Promise struct {
 	f      int
 	decIdx int
 	sfx    []any
+
+	// set when sfx starts at snapIdx because the entries before it were
+	// compacted by the promising follower
+	snapshot []byte
+	snapIdx  int
+	sessions map[int64]Session
 }
 
 type OmniPaxos struct {
 	mu            sync.Mutex
-	peers         []*labrpc.ClientEnd
+	transport     Transport // see transport.go
+	npeers        int       // servers in the configuration, us included
 	persister     *Persister
 	me            int
+	config        Config // see options.go
 	dead          int32
 	enableLogging int32
 
@@ -85,6 +99,15 @@ type OmniPaxos struct {
 	acceptedRnd BallotNumber //bn
 	decidedIdx  int
 
+	// log compaction: the first compactedIdx entries have been replaced by
+	// the service's snapshot, so op.log[0] is the entry at compactedIdx.
+	// Indices everywhere else are absolute.
+	compactedIdx int
+
+	// the log of this configuration starts at configIdx; everything
+	// before it was decided in the previous one (see reconfig.go)
+	configIdx int
+
 	// STATE
 	role  Role
 	phase Phase
@@ -94,7 +117,23 @@ type OmniPaxos struct {
 	promises   map[int]Promise // map from follower ID to their promise
 	maxProm    Promise
 	accepted   []int
-	buffer     []any // client requests
+	buffer     []any              // client requests
+	buffered   []bufferedProposal // one per buffer entry, see proposal.go
+	syncXfer   int                // id of the last AcceptSync transfer we started
+
+	// entries from batchStart on have not been sent to the followers yet
+	batchStart   int
+	flushPending bool
+	proposals    map[int]pendingProposal // by index, see future.go
+	forwarding   bool                    // see forward.go
+
+	// leadership transfer (see transfer.go): the server we are handing
+	// leadership to, or -1, and a request to take over from the leader
+	transferTarget int
+	takeover       takeover
+	// decidedIdx the followers have been sent, on an Accept or a Decide
+	sentDecIdx    int
+	decidePending bool
 
 	// ballot leader election algorithm state
 	L       BallotNumber // ballot number of curr leader
@@ -103,14 +142,60 @@ type OmniPaxos struct {
 	qc      bool         // qourum connected
 	delay   time.Duration
 	ballots []Ballot
+	// the previous round's replies, for those that missed its timeout
+	lateBallotsCh chan Ballot
+	// whether our last round heard from the leader, and if not, for how
+	// many rounds it hasn't (see prevote.go)
+	leaderAlive      bool
+	missedLeaderRnds int
+	bleStats         BLEStats
 
 	//custom recovery mechanisms
 	LinkDrop         bool
 	LinkLastHBRound  int
-	disconnectedRnds map[int]int // track consecutive rounds without heartbeat per peer
-
-	// Semaphore for serializing RPC calls
-	serializeCh chan struct{}
+	disconnectedRnds map[int]int   // track consecutive rounds without heartbeat per peer
+	rtts             []rttEstimate // heartbeat round-trip times by peer (see rtt.go)
+	holeIdx          int           // start of a hole in the log seen last round, or -1
+	leaderDecIdx     int           // highest decidedIdx the leader has told us about
+	incoming         syncTransfer
+
+	// client sessions (see session.go): the table as of the last applied
+	// entry, and as of compactedIdx
+	sessions     map[int64]Session
+	snapSessions map[int64]Session
+
+	// log cleaning (see logcleaning.go)
+	keyOf      KeyFunc
+	cleanedIdx int            // decided entries before this have been cleaned
+	appliedIdx int            // entries before this have been handed to the applier's batch
+	latest     map[string]int // index of the latest decided entry per key
+
+	// one FIFO send queue per peer (see outbox.go)
+	outboxes []*outbox
+
+	// the applier (see applymsg.go) and ReadIndex wait on applyCond for
+	// decisions
+	applyCond   *sync.Cond
+	decideMarks []decideMark // decisions the applier has not delivered yet
+	appliedMark int          // entries before this are in the stats
+	applyCount  int
+	applyTotal  time.Duration
+	applyMax    time.Duration
+
+	// leader leases (see lease.go): the ballot we granted a lease to as a
+	// follower, or hold one for as the leader, and when it runs out on
+	// our clock
+	leaseRnd   BallotNumber
+	leaseUntil time.Time
+	clock      func() time.Time
+
+	// equivocation detection (see equivocation.go): digests of the
+	// entries we accepted, and the conflicts found with the peers'
+	digests       map[digestKey]uint64
+	digestLog     []recordedDigest // in the order recorded
+	equivocations []Equivocation
+	// test hook: rewrites the entries of an Accept to a peer
+	equivocate func(peer int, entries []any) []any
 }
 
 // As each OmniPaxos peer becomes aware that successive log entries are
@@ -118,10 +203,29 @@ type OmniPaxos struct {
 // tester) on the same server, via the applyCh passed to Make(). Set
 // CommandValid to true to indicate that the ApplyMsg contains a newly
 // committed log entry.
+//
+// When a lagging server is caught up from another server's snapshot
+// instead of a log suffix, it sends an ApplyMsg with SnapshotValid set
+// instead. The snapshot covers all entries up to and including
+// SnapshotIndex, and the next command has index SnapshotIndex+1.
+//
+// A decided StopSign is sent with StopSignValid set and CommandValid
+// false, at its CommandIndex. An entry removed by log cleaning, or a
+// duplicate of a session command (see session.go), is sent with neither
+// set.
 type ApplyMsg struct {
 	CommandValid bool
 	Command      interface{}
 	CommandIndex int
+
+	// For snapshots:
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotIndex int
+
+	// For reconfiguration:
+	StopSignValid bool
+	StopSign      StopSign
 }
 
 // GetState Return the current leader's ballot and whether this server
@@ -140,18 +244,131 @@ func (op *OmniPaxos) GetState() (int, bool) {
 	return ballot, isleader
 }
 
+// persistentState is the durable part of a server's state, as described in
+// the paper: everything a server must remember across crashes so that it
+// never breaks a promise or forgets an accepted entry.
+type persistentState struct {
+	Log          []any
+	CompactedIdx int
+	ConfigIdx    int
+	PromisedRnd  BallotNumber
+	AcceptedRnd  BallotNumber
+	DecidedIdx   int
+	B            BallotNumber
+	Sessions     map[int64]Session // session table as of CompactedIdx
+}
+
+// persist saves the durable state to stable storage. It must be called
+// while holding op.mu, before sending any message that depends on the
+// state that was just changed.
+func (op *OmniPaxos) persist() {
+	op.persister.SaveState(op.encodeState())
+}
+
+func (op *OmniPaxos) encodeState() []byte {
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	state := persistentState{op.log, op.compactedIdx, op.configIdx, op.promisedRnd, op.acceptedRnd, op.decidedIdx, op.B, op.snapSessions}
+	if err := e.Encode(state); err != nil {
+		log.Fatal().Msgf("[SERVER=%d] persist: %v", op.me, err)
+	}
+	return w.Bytes()
+}
+
+// readPersist restores previously persisted state. It returns false if
+// there was no state to restore, i.e. the server is starting fresh.
+func (op *OmniPaxos) readPersist(data []byte) bool {
+	if len(data) < 1 {
+		return false
+	}
+	r := bytes.NewBuffer(data)
+	d := gob.NewDecoder(r)
+	var state persistentState
+	if err := d.Decode(&state); err != nil {
+		log.Error().Msgf("[SERVER=%d] readPersist: %v", op.me, err)
+		return false
+	}
+	op.log = state.Log
+	op.compactedIdx = state.CompactedIdx
+	op.configIdx = state.ConfigIdx
+	op.promisedRnd = state.PromisedRnd
+	op.acceptedRnd = state.AcceptedRnd
+	op.decidedIdx = state.DecidedIdx
+	if state.Sessions != nil {
+		op.snapSessions = state.Sessions
+	}
+	// the state may come from another server (see NewConfigState), and
+	// priorities are not persisted (see SetPriority)
+	op.B = BallotNumber{state.B.Value, 0, op.me}
+	return true
+}
+
+// Snapshot is called by the service once it has created a snapshot that
+// includes all entries up to and including index. OmniPaxos discards those
+// entries from its log and saves the snapshot together with its state.
+// Only decided entries can be compacted.
+func (op *OmniPaxos) Snapshot(index int, snapshot []byte) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	// keep our StopSign in the log, stopped() looks for it there
+	if op.stopped() && index == op.logLen()-1 {
+		index--
+	}
+	if index < op.compactedIdx || index >= op.decidedIdx {
+		return
+	}
+	op.advanceSnapSessions(index + 1)
+	// copy, so the compacted entries can be garbage collected
+	op.log = append([]any{}, op.log[index+1-op.compactedIdx:]...)
+	op.compactedIdx = index + 1
+	op.persister.SaveStateAndSnapshot(op.encodeState(), snapshot)
+}
+
+// installSnapshot replaces the log up to idx with a snapshot received from
+// another server that has compacted its log further than we have, along
+// with that server's session table as of idx.
+// Entries past the snapshot are kept; callers overwrite them as needed.
+// The apply loop hands the snapshot to the service.
+func (op *OmniPaxos) installSnapshot(snapshot []byte, idx int, sessions map[int64]Session) {
+	if idx <= op.compactedIdx {
+		return
+	}
+	op.snapSessions = copySessions(sessions)
+	if idx < op.logLen() {
+		op.log = append([]any{}, op.log[idx-op.compactedIdx:]...)
+	} else {
+		op.log = []any{}
+	}
+	op.compactedIdx = idx
+	op.setDecided(idx)
+	op.persister.SaveStateAndSnapshot(op.encodeState(), snapshot)
+	op.applyCond.Broadcast()
+}
+
 func (op *OmniPaxos) initOmniPaxos() {
-	op.L = BallotNumber{-1, -1}
+	op.L = BallotNumber{-1, -1, -1}
 	op.R = 0
-	op.B = BallotNumber{0, op.me}
+	op.B = BallotNumber{0, 0, op.me}
 	op.qc = true
-	op.delay = 100 * time.Millisecond
+	op.delay = op.config.HeartbeatPeriod
 	op.ballots = nil
 	op.decidedIdx = -1
 	op.LinkDrop = false
 	op.LinkLastHBRound = 0
+	op.holeIdx = -1
+	op.leaderDecIdx = -1
+	op.leaseRnd = BallotNumber{-1, -1, -1}
+	op.sessions = make(map[int64]Session)
+	op.proposals = make(map[int]pendingProposal)
+	op.transferTarget = -1
+	op.takeover = takeover{logIdx: -1}
+	op.snapSessions = make(map[int64]Session)
+	op.clock = time.Now
+	op.digests = make(map[digestKey]uint64)
 	op.disconnectedRnds = make(map[int]int)
-	for i := range op.peers {
+	op.rtts = make([]rttEstimate, op.npeers)
+	for i := range op.npeers {
 		op.disconnectedRnds[i] = 0
 	}
 }
@@ -163,50 +380,113 @@ func (op *OmniPaxos) startTimer(delay time.Duration) {
 	}
 
 	op.mu.Lock()
-	if op.R > op.LinkLastHBRound+3 {
+	if op.R > op.LinkLastHBRound+op.config.LinkDropRounds {
 		op.LinkDrop = true
 	}
 	// make buffered channel to store ballot results from heartbeats
-	ballotsCh := make(chan Ballot, len(op.peers))
-	op.mu.Unlock()
-
+	ballotsCh := make(chan Ballot, op.npeers)
 	// upon timeout of start timer
 	timeoutCh := time.After(op.delay)
+	// stop waiting for replies after this
+	deadline := time.Now().Add(op.heartbeatTimeout())
+	op.mu.Unlock()
+
 	wg := sync.WaitGroup{}
 
-	op.sendHBRequest(&wg, ballotsCh, timeoutCh)
+	op.sendHBRequest(&wg, ballotsCh)
 
 	<-timeoutCh
-	wg.Wait()
-	close(ballotsCh)
+	replied := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(replied)
+	}()
+	select {
+	case <-replied:
+	case <-time.After(time.Until(deadline)):
+	}
 	op.mu.Lock()
 	defer op.mu.Unlock()
 	op.ballots = append(op.ballots, Ballot{op.B, op.qc})
-	for ballot := range ballotsCh {
-		op.ballots = append(op.ballots, ballot)
+	for len(ballotsCh) > 0 {
+		op.ballots = append(op.ballots, <-ballotsCh)
+	}
+	// replies that come in after this are counted next round
+	heard := make(map[int]bool)
+	for _, ballot := range op.ballots {
+		heard[ballot.BallotNumber.Pid] = true
+	}
+	for len(op.lateBallotsCh) > 0 {
+		if ballot := <-op.lateBallotsCh; !heard[ballot.BallotNumber.Pid] {
+			op.ballots = append(op.ballots, ballot)
+		}
 	}
+	op.lateBallotsCh = ballotsCh
 
-	if len(op.ballots) > (len(op.peers) / 2) {
+	if len(op.ballots) > (op.npeers / 2) {
+		// we are quorum-connected, whether or not a pre-vote lets us
+		// raise our ballot (see prevote.go)
+		op.qc = true
 		op.checkLeader()
 	} else {
 		op.qc = false
+		op.leaderAlive = false
 	}
 
 	// for each pair, check consecutive rounds of not receiving a heartbeat
-	for pid := range op.peers {
+	for pid := range op.npeers {
 		op.disconnectedRnds[pid] += 1
 	}
 
 	for _, ballot := range op.ballots {
 		pid := ballot.BallotNumber.Pid
-		if op.disconnectedRnds[pid] >= 4 {
-			// we reconnected to pid after 3 consecutive no-heartbeat rounds
+		if op.disconnectedRnds[pid] >= op.config.ReconnectRounds {
+			// we reconnected to pid after consecutive no-heartbeat rounds
 			op.reconnected(pid)
 		}
 		op.disconnectedRnds[pid] = 0
 	}
 	op.Debug("startTimer(%v): disconnectedRnds: %v", op.R, op.disconnectedRnds)
 
+	// a hole (or a decided entry we never got) that outlives a whole
+	// round was lost rather than reordered
+	behind := op.receivedLen() < max(op.logLen(), op.leaderDecIdx)
+	if op.role == FOLLOWER && op.phase == ACCEPT && behind {
+		if op.holeIdx == op.receivedLen() {
+			op.phase = RECOVER
+		}
+		op.holeIdx = op.receivedLen()
+	} else {
+		op.holeIdx = -1
+	}
+
+	// a chunked AcceptSync that made no progress for a whole round lost
+	// a chunk; ask the leader to start over
+	if op.role == FOLLOWER && op.phase == PREPARE && op.incoming.chunks > 0 {
+		if op.incoming.chunks == op.incoming.seen {
+			op.phase = RECOVER
+		}
+		op.incoming.seen = op.incoming.chunks
+	}
+
+	if op.R%cleanEveryRounds == 0 {
+		op.cleanLog()
+	}
+
+	op.checkTakeover()
+
+	// nothing we proposed as leader will be decided through us now
+	if op.role != LEADER {
+		op.failProposals(0, ErrLeaderChanged)
+		op.dropBuffered(ErrLeaderChanged)
+	}
+
+	// a recovering server keeps asking the leader for a Prepare until
+	// it has been resynchronized
+	if op.phase == RECOVER && op.L.Pid >= 0 && op.L.Pid != op.me {
+		op.sendPrepareRecoveringFollower(op.L.Pid)
+	}
+
 	// clear ballots
 	op.ballots = nil
 	op.R += 1
@@ -218,10 +498,11 @@ func (op *OmniPaxos) startTimer(delay time.Duration) {
 // The service using OmniPaxos (e.g. a k/v server) wants to start
 // agreement on the next command to be appended to OmniPaxos's log. If this
 // server isn't the leader, returns false. Otherwise start the
-// agreement and return immediately. There is no guarantee that this
-// command will ever be committed to the OmniPaxos log, since the leader
-// may fail or lose an election. Even if the OmniPaxos instance has been killed,
-// this function should return gracefully.
+// agreement and return without waiting for it to be decided. There is
+// no guarantee that this command will ever be committed to the OmniPaxos
+// log, since the leader may fail or lose an election. Even if the
+// OmniPaxos instance has been killed, this function should return
+// gracefully.
 //
 // The first return value is the index that the command will appear at
 // if it's ever committed. The second return value is the current
@@ -239,6 +520,12 @@ func (op *OmniPaxos) startTimer(delay time.Duration) {
 // should call killed() to check whether it should stop.
 func (op *OmniPaxos) Kill() {
 	atomic.StoreInt32(&op.dead, 1)
+	op.stopOutboxes()
+	op.mu.Lock()
+	op.applyCond.Broadcast()
+	op.failProposals(0, ErrKilled)
+	op.dropBuffered(ErrKilled)
+	op.mu.Unlock()
 	// Your code here, if desired.
 	// you may set a variable to false to
 	// disable logs as soon as a server is killed
@@ -262,18 +549,55 @@ func (op *OmniPaxos) killed() bool {
 func Make(peers []*labrpc.ClientEnd, me int,
 	persister *Persister, applyCh chan ApplyMsg) *OmniPaxos {
 
+	op, _ := MakeWithConfig(peers, me, persister, applyCh, DefaultConfig())
+	return op
+}
+
+// MakeWithConfig is Make with the timing and batching parameters in
+// config instead of the defaults. It fails if config is not valid.
+func MakeWithConfig(peers []*labrpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyMsg, config Config) (*OmniPaxos, error) {
+	return MakeWithTransport(LabrpcTransport(peers), me, persister, applyCh, config)
+}
+
+// MakeWithTransport is MakeWithConfig for servers that reach each other
+// through transport rather than labrpc. The server's handlers must be
+// reachable through the other servers' transports.
+func MakeWithTransport(transport Transport, me int,
+	persister *Persister, applyCh chan ApplyMsg, config Config) (*OmniPaxos, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	op := &OmniPaxos{}
-	op.peers = peers
+	op.transport = transport
+	op.npeers = transport.Peers()
 	op.persister = persister
 	op.me = me
+	op.config = config
 
 	// Your initialization code here (3, 4).
 	log.Info().Msgf("Hello from OmniPaxos!")
 	op.initOmniPaxos()
-	op.serializeCh = make(chan struct{}, 1) // buffered semaphore
+	op.startOutboxes()
+	op.applyCond = sync.NewCond(&op.mu)
+
+	// initialize from state persisted before a crash. A recovering
+	// server must resynchronize with the leader before it accepts
+	// anything, so it starts in the RECOVER phase (Figure 3.5).
+	if op.readPersist(persister.ReadState()) {
+		op.role = FOLLOWER
+		op.phase = RECOVER
+		// we may have granted a lease before the crash
+		op.leaseUntil = op.clock().Add(op.config.LeaseDuration)
+		log.Info().Msgf("Server %v recovered: log %v (compacted %v), promisedRnd %v, acceptedRnd %v, decidedIdx %v",
+			op.me, op.logLen(), op.compactedIdx, op.promisedRnd, op.acceptedRnd, op.decidedIdx)
+	}
 
 	// start looking for leaders!
 	go op.startTimer(op.delay)
-	go op.applymsg(applyCh, 0)
-	return op
+	// entries decided before a restart are not counted in ApplyStats
+	op.appliedMark = max(op.decidedIdx, 0)
+	go op.applier(applyCh)
+	return op, nil
 }
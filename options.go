@@ -0,0 +1,96 @@
+package omnipaxos
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config holds the timing and batching parameters of a server. Make uses
+// DefaultConfig, which suits servers on a LAN; MakeWithConfig takes one
+// tuned for the deployment. Thresholds are counted in heartbeat rounds,
+// so they scale with HeartbeatPeriod.
+type Config struct {
+	// BLE runs a round of heartbeats every HeartbeatPeriod
+	HeartbeatPeriod time.Duration
+	// a round waits for heartbeat replies for a timeout that adapts to
+	// the peers' round-trip times, within these bounds (see rtt.go).
+	// A round ends early once every peer has replied, but while one is
+	// down each round lasts at least MinHeartbeatTimeout, and never less
+	// than HeartbeatPeriod. The default of 0 leaves the floor at
+	// HeartbeatPeriod, so a leader that goes down is replaced as fast as
+	// the rounds allow; raising it rides out a sudden slowdown the
+	// estimate has not caught up with, at the cost of slower failover.
+	MinHeartbeatTimeout time.Duration
+	MaxHeartbeatTimeout time.Duration
+	// a server that has not heard from the leader for LinkDropRounds
+	// rounds recovers from it once it does
+	LinkDropRounds int
+	// a peer that answers after ReconnectRounds silent rounds has
+	// reconnected
+	ReconnectRounds int
+	// how long a follower's lease for the leader lasts (see lease.go)
+	LeaseDuration time.Duration
+
+	// the leader sends an Accept once AcceptBatchSize entries are waiting,
+	// or AcceptBatchWindow after the first of them was proposed
+	AcceptBatchSize   int
+	AcceptBatchWindow time.Duration
+	// how long Proposal waits for a command buffered while the leader
+	// prepares its round before withdrawing it
+	BufferedProposalTimeout time.Duration
+	// the applier delivers at most ApplyBatchSize entries between looks
+	// at the log, or all that are decided if it is 0
+	ApplyBatchSize int
+	// the size of the chunks a long AcceptSync is streamed in (see sync.go)
+	SyncChunkEntries   int
+	SnapshotChunkBytes int
+}
+
+// DefaultConfig returns the configuration Make uses
+func DefaultConfig() Config {
+	return Config{
+		HeartbeatPeriod:         100 * time.Millisecond,
+		MinHeartbeatTimeout:     0,
+		MaxHeartbeatTimeout:     time.Second,
+		LinkDropRounds:          3,
+		ReconnectRounds:         4,
+		LeaseDuration:           leaseDuration,
+		AcceptBatchSize:         acceptBatchSize,
+		AcceptBatchWindow:       acceptBatchWindow,
+		BufferedProposalTimeout: bufferedProposalTimeout,
+		ApplyBatchSize:          0,
+		SyncChunkEntries:        syncChunkEntries,
+		SnapshotChunkBytes:      snapshotChunkBytes,
+	}
+}
+
+// Validate reports the first parameter that is out of range
+func (c Config) Validate() error {
+	switch {
+	case c.HeartbeatPeriod <= 0:
+		return fmt.Errorf("omnipaxos: HeartbeatPeriod %v must be positive", c.HeartbeatPeriod)
+	case c.MinHeartbeatTimeout < 0:
+		return fmt.Errorf("omnipaxos: MinHeartbeatTimeout %v must not be negative", c.MinHeartbeatTimeout)
+	case c.MaxHeartbeatTimeout < c.MinHeartbeatTimeout:
+		return fmt.Errorf("omnipaxos: MaxHeartbeatTimeout %v must be at least MinHeartbeatTimeout %v", c.MaxHeartbeatTimeout, c.MinHeartbeatTimeout)
+	case c.LinkDropRounds < 1:
+		return fmt.Errorf("omnipaxos: LinkDropRounds %v must be at least 1", c.LinkDropRounds)
+	case c.ReconnectRounds < 1:
+		return fmt.Errorf("omnipaxos: ReconnectRounds %v must be at least 1", c.ReconnectRounds)
+	case c.LeaseDuration < 0:
+		return fmt.Errorf("omnipaxos: LeaseDuration %v must not be negative", c.LeaseDuration)
+	case c.AcceptBatchSize < 1:
+		return fmt.Errorf("omnipaxos: AcceptBatchSize %v must be at least 1", c.AcceptBatchSize)
+	case c.AcceptBatchWindow < 0:
+		return fmt.Errorf("omnipaxos: AcceptBatchWindow %v must not be negative", c.AcceptBatchWindow)
+	case c.BufferedProposalTimeout <= 0:
+		return fmt.Errorf("omnipaxos: BufferedProposalTimeout %v must be positive", c.BufferedProposalTimeout)
+	case c.ApplyBatchSize < 0:
+		return fmt.Errorf("omnipaxos: ApplyBatchSize %v must not be negative", c.ApplyBatchSize)
+	case c.SyncChunkEntries < 1:
+		return fmt.Errorf("omnipaxos: SyncChunkEntries %v must be at least 1", c.SyncChunkEntries)
+	case c.SnapshotChunkBytes < 1:
+		return fmt.Errorf("omnipaxos: SnapshotChunkBytes %v must be at least 1", c.SnapshotChunkBytes)
+	}
+	return nil
+}
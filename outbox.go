@@ -0,0 +1,111 @@
+package omnipaxos
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Outbound messages go through one FIFO queue per peer, each drained by
+// its own goroutine. Messages to a peer are sent one at a time in the
+// order they were queued, so a follower sees Accepts in log order, while
+// a slow or partitioned peer only holds up its own queue. Heartbeats are
+// sent directly, since BLE times their rounds itself.
+//
+// A failed call means the peer is unreachable or the message was lost.
+// Whatever is queued behind it is dropped: the peer would see a gap
+// anyway, and it resynchronizes through recovery like after any lost
+// message. This also keeps the queue of a partitioned peer from growing.
+
+type outbox struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []any // message args, sent with the Transport method for their type
+}
+
+func (op *OmniPaxos) startOutboxes() {
+	op.outboxes = make([]*outbox, op.npeers)
+	for i := range op.npeers {
+		if i == op.me {
+			continue
+		}
+		ob := &outbox{}
+		ob.cond = sync.NewCond(&ob.mu)
+		op.outboxes[i] = ob
+		go op.drain(i, ob)
+	}
+}
+
+// send queues the message args for peer pid. It does not block, so it
+// may be called holding op.mu.
+func (op *OmniPaxos) send(pid int, args any) {
+	ob := op.outboxes[pid]
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.queue = append(ob.queue, args)
+	ob.cond.Signal()
+}
+
+// deliver sends args to pid with the Transport method for its type
+func (op *OmniPaxos) deliver(pid int, args any) bool {
+	switch args := args.(type) {
+	case *PrepareRequest:
+		return op.transport.Prepare(pid, args)
+	case *PromiseFromFollowerRequest:
+		return op.transport.Promise(pid, args)
+	case *AcceptSyncFromLeaderRequest:
+		return op.transport.AcceptSync(pid, args)
+	case *SyncChunkFromLeaderRequest:
+		return op.transport.SyncChunk(pid, args)
+	case *AcceptFromLeaderRequest:
+		return op.transport.Accept(pid, args)
+	case *AcceptedFromFollowerRequest:
+		return op.transport.Accepted(pid, args)
+	case *DecideFromLeaderRequest:
+		return op.transport.Decide(pid, args)
+	case *PrepareRecoveringFollowerRequest:
+		return op.transport.PrepareRecoveringFollower(pid, args)
+	case *TakeLeadershipRequest:
+		return op.transport.TakeLeadership(pid, args)
+	}
+	log.Fatal().Msgf("send: no Transport method for %T", args)
+	return false
+}
+
+func (op *OmniPaxos) drain(pid int, ob *outbox) {
+	for {
+		ob.mu.Lock()
+		for len(ob.queue) == 0 && !op.killed() {
+			ob.cond.Wait()
+		}
+		if op.killed() {
+			ob.queue = nil
+			ob.mu.Unlock()
+			return
+		}
+		args := ob.queue[0]
+		ob.queue[0] = nil
+		ob.queue = ob.queue[1:]
+		ob.mu.Unlock()
+
+		if !op.deliver(pid, args) {
+			ob.mu.Lock()
+			dropped := len(ob.queue)
+			ob.queue = nil
+			ob.mu.Unlock()
+			log.Info().Msgf("[SERVER=%d] %T to %v failed, dropped %v queued", op.me, args, pid, dropped)
+		}
+	}
+}
+
+// stopOutboxes wakes the queue goroutines so they exit after Kill
+func (op *OmniPaxos) stopOutboxes() {
+	for _, ob := range op.outboxes {
+		if ob == nil {
+			continue
+		}
+		ob.mu.Lock()
+		ob.cond.Broadcast()
+		ob.mu.Unlock()
+	}
+}
@@ -0,0 +1,89 @@
+package omnipaxos
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Pre-vote. A quorum-connected server that stops hearing from the leader
+// does not raise its ballot straight away: it first asks its peers
+// whether they would follow it. A peer says yes if it has lost the
+// leader too, or if the server has missed the leader for LinkDropRounds
+// rounds in a row, as when it is cut off from the leader for good (the
+// chained scenario of the OmniPaxos paper). A server whose link to the
+// leader only flaps is turned down, and leaves the ballots alone instead
+// of taking over leadership every time the link drops.
+
+type PreVoteRequest struct {
+	Me     int
+	N      BallotNumber // the ballot we would raise ours to
+	Missed int          // rounds in a row we have missed the leader
+}
+
+type PreVoteReply struct {
+	Granted bool
+}
+
+// BLEStats counts how often a server raised its ballot, and the
+// pre-votes it held first
+type BLEStats struct {
+	BallotIncrements int
+	PreVotes         int
+	PreVotesGranted  int
+}
+
+// BLEStats returns this server's ballot statistics since it started
+func (op *OmniPaxos) BLEStats() BLEStats {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.bleStats
+}
+
+// preVote asks the peers whether they would follow us with ballot n, and
+// raises our ballot to n if a majority would. Must hold op.mu.
+func (op *OmniPaxos) preVote(n BallotNumber) {
+	op.bleStats.PreVotes++
+	req := PreVoteRequest{op.me, n, op.missedLeaderRnds}
+	b := op.B
+	grants := 0
+	// grant counts a vote for n, and the first majority raises our
+	// ballot, unless it has moved on since. Must hold op.mu.
+	grant := func() {
+		grants++
+		if grants == op.npeers/2+1 && op.B == b && op.L.Value+1 == n.Value {
+			log.Info().Msgf("preVote(%v): granted, inc(l), qc = true", n)
+			op.bleStats.PreVotesGranted++
+			op.bleStats.BallotIncrements++
+			op.B = n
+			op.qc = true
+			op.persist()
+		}
+	}
+	grant()
+	for i := range op.npeers {
+		if i == op.me {
+			continue
+		}
+		i := i // capture loop variable
+		go func() {
+			reply := PreVoteReply{}
+			if !op.transport.PreVote(i, &req, &reply) {
+				log.Info().Msgf("preVote(%v): no response from %v", n, i)
+				return
+			}
+			op.mu.Lock()
+			defer op.mu.Unlock()
+
+			if reply.Granted {
+				grant()
+			}
+		}()
+	}
+}
+
+func (op *OmniPaxos) PreVote(args *PreVoteRequest, res *PreVoteReply) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	res.Granted = args.N.Compare(op.L) > 0 &&
+		(!op.leaderAlive || args.Missed >= op.config.LinkDropRounds)
+}
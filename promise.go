@@ -1,6 +1,10 @@
 package omnipaxos
 
-import "github.com/rs/zerolog/log"
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
 
 // work on figure (3.4) Promise from Follower f
 // connected to leader.go
@@ -12,6 +16,12 @@ type PromiseFromFollowerRequest struct {
 	LogIdx int
 	DecIdx int
 	Sfx    []any
+
+	// set if the leader asked for entries we have compacted; Sfx then
+	// starts at SnapshotIdx
+	Snapshot    []byte
+	SnapshotIdx int
+	Sessions    map[int64]Session
 }
 
 type AcceptSyncFromLeaderRequest struct {
@@ -19,6 +29,18 @@ type AcceptSyncFromLeaderRequest struct {
 	N       BallotNumber
 	Sfx     []any
 	Syncidx int
+	DecIdx  int // leader's decidedIdx, so a separate Decide can't overtake the sync
+
+	// set if the follower needs entries the leader has compacted; Syncidx
+	// is then SnapshotIdx
+	Snapshot    []byte
+	SnapshotIdx int
+	Sessions    map[int64]Session
+
+	// the first Chunks pieces of Snapshot and Sfx were sent ahead as
+	// transfer Xfer (see sync.go)
+	Xfer   int
+	Chunks int
 }
 
 // Recieve Prepare Request
@@ -32,35 +54,43 @@ func (op *OmniPaxos) RecievePrepare(args *PrepareRequest, res *DummyReply) {
 		op.mu.Unlock()
 		return
 	}
+	// promise once the lease we granted another leader has run out
+	if wait := op.leaseWait(args.N); wait > 0 {
+		op.mu.Unlock()
+		time.AfterFunc(wait, func() { op.RecievePrepare(args, &DummyReply{}) })
+		return
+	}
 	//  State ← (FOLLOWER, PREPARE)
 	op.role = FOLLOWER
 	op.phase = PREPARE
 
 	// promsiedRnd  ←  n
 	op.promisedRnd = args.N
+	// drop anything past a hole left by an out-of-order accept
+	op.log = op.prefix(op.receivedLen())
+	op.persist()
 	sfx := []any{}
+	sfxIdx := -1
 	if op.acceptedRnd.Compare(args.AccRnd) == 1 {
-		sfx = op.suffix(args.DecIdx)
+		// a leader that has decided nothing sends decidedIdx -1
+		sfxIdx = max(args.DecIdx, 0)
 	} else if op.acceptedRnd == args.AccRnd {
-		sfx = op.suffix(args.LogIdx)
+		sfxIdx = args.LogIdx
+	}
+	var snapshot []byte
+	var sessions map[int64]Session
+	snapshotIdx := 0
+	if sfxIdx >= 0 {
+		if sfxIdx < op.compactedIdx {
+			// the leader is missing entries we no longer have
+			snapshot, snapshotIdx, sessions = op.syncSnapshot(sfxIdx)
+			sfxIdx = op.compactedIdx
+		}
+		sfx = append([]any{}, op.suffix(sfxIdx)...)
 	}
 
-	leader := op.peers[args.Me]
-	accRnd := op.acceptedRnd
-	logLen := len(op.log)
-	decidedIdx := op.decidedIdx
+	op.send(args.Me, &PromiseFromFollowerRequest{op.me, args.N, op.acceptedRnd, op.logLen(), op.decidedIdx, sfx, snapshot, snapshotIdx, sessions})
 	op.mu.Unlock()
-
-	go func() {
-		op.serializeCh <- struct{}{}        // acquire semaphore
-		defer func() { <-op.serializeCh }() // release
-		req := PromiseFromFollowerRequest{op.me, args.N, accRnd, logLen, decidedIdx, sfx}
-
-		if !leader.Call("OmniPaxos.PromiseFromFollower", &req, &DummyReply{}) {
-			log.Info().Msgf("ReceievePrepare(%v): no response from %v", op.R, args.Me)
-			return
-		}
-	}()
 }
 
 // Leader gets this
@@ -76,14 +106,14 @@ func (op *OmniPaxos) PromiseFromFollower(args *PromiseFromFollowerRequest, res *
 		return
 	}
 
-	op.promises[args.Me] = Promise{args.AccRnd, args.LogIdx, args.Me, args.DecIdx, args.Sfx}
+	op.promises[args.Me] = Promise{args.AccRnd, args.LogIdx, args.Me, args.DecIdx, args.Sfx, args.Snapshot, args.SnapshotIdx, args.Sessions}
 
 	if op.role == LEADER && op.phase == PREPARE {
 		// P1. return if |promises| < majority
 		// op.mu.Lock()
 		// defer op.mu.Unlock()
 		log.Info().Msgf("Proimise From Follower %v - |Promises| = %v", op.me, op.promises)
-		if len(op.promises) <= len(op.peers)/2 {
+		if len(op.promises) <= op.npeers/2 {
 			return
 		}
 
@@ -100,6 +130,15 @@ func (op *OmniPaxos) PromiseFromFollower(args *PromiseFromFollowerRequest, res *
 		// P3. if maxProm.accRnd ≠ acceptedRnd then
 		// log ← prefix(decidedIdx)
 		if op.maxProm.accRnd != op.acceptedRnd {
+			// entries we proposed in an earlier round are replaced
+			op.failProposals(op.decidedIdx, ErrOverwritten)
+		}
+		if op.maxProm.snapIdx > 0 {
+			// maxProm's suffix starts after its snapshot, which covers
+			// entries past our own log or decidedIdx
+			op.installSnapshot(op.maxProm.snapshot, op.maxProm.snapIdx, op.maxProm.sessions)
+			op.log = op.prefix(op.maxProm.snapIdx)
+		} else if op.maxProm.accRnd != op.acceptedRnd {
 			op.log = op.prefix(op.decidedIdx)
 		}
 
@@ -108,18 +147,21 @@ func (op *OmniPaxos) PromiseFromFollower(args *PromiseFromFollowerRequest, res *
 
 		// P5. if stopped()then clear buffer else append buffer to the log
 		if op.stopped() {
-			op.buffer = make([]any, 0)
+			op.dropBuffered(ErrStopped)
 		} else {
-			op.log = append(op.log, op.buffer...)
+			op.placeBuffered()
 		}
 
 		// P6. acceptedRnd ← currentRnd,
 		// accepted[self] ← |log|, state ← (LEADER, ACCEPT)
 		op.acceptedRnd = op.currentRnd
-		op.accepted[op.me] = len(op.log)
+		op.accepted[op.me] = op.logLen()
+		op.batchStart = op.logLen() // the AcceptSyncs carry everything before
+		op.sentDecIdx = op.decidedIdx
 
 		op.role = LEADER
 		op.phase = ACCEPT
+		op.persist()
 
 		// P7.
 		// foreach p in promises:
@@ -129,93 +171,111 @@ func (op *OmniPaxos) PromiseFromFollower(args *PromiseFromFollowerRequest, res *
 		// syncIdx⟩ to p.f
 
 		for _, p := range op.promises {
+			if p.f == op.me {
+				// our own log is already synchronized
+				continue
+			}
 			var syncidx int
 			if p.accRnd == op.maxProm.accRnd {
 				syncidx = p.logIdx
 			} else {
 				syncidx = p.decIdx
 			}
-			sfx := op.suffix(syncidx)
-			peer := op.peers[p.f]
-			me := op.me
-			currentRnd := op.currentRnd
-
-			go func() {
-				op.serializeCh <- struct{}{}        // acquire semaphore
-				defer func() { <-op.serializeCh }() // release
-				req := AcceptSyncFromLeaderRequest{me, currentRnd, sfx, syncidx}
-				if !peer.Call("OmniPaxos.AcceptSyncFromLeader", &req, &DummyReply{}) {
-					log.Info().Msgf("accept sync from leader failed %v %v",
-						me, p.f)
-				}
-			}()
+			snapshot, snapshotIdx, sessions := op.syncSnapshot(syncidx)
+			syncidx = max(syncidx, snapshotIdx)
+			sfx := append([]any{}, op.suffix(syncidx)...)
+			op.sendAcceptSync(p.f, AcceptSyncFromLeaderRequest{op.me, op.currentRnd, sfx, syncidx, op.decidedIdx, snapshot, snapshotIdx, sessions, 0, 0})
 		}
 	}
 
 	if op.role == LEADER && op.phase == ACCEPT {
 		var syncidx int
-		if args.AccRnd == op.maxProm.accRnd {
-			syncidx = op.maxProm.logIdx
+		if args.AccRnd == op.currentRnd {
+			// everything the follower holds was accepted from us
+			syncidx = args.LogIdx
+		} else if args.AccRnd == op.maxProm.accRnd {
+			// the follower may be behind maxProm, and may also hold
+			// entries past it that were never chosen
+			syncidx = min(args.LogIdx, op.maxProm.logIdx)
 		} else {
 			syncidx = args.DecIdx
 		}
+		snapshot, snapshotIdx, sessions := op.syncSnapshot(syncidx)
+		syncidx = max(syncidx, snapshotIdx)
 
-		peer := op.peers[args.Me]
-		sfx := op.suffix(syncidx)
-		me := op.me
-		currentRnd := op.currentRnd
-		decidedIdx := op.decidedIdx
-
-		go func() {
-			op.serializeCh <- struct{}{}        // acquire semaphore
-			defer func() { <-op.serializeCh }() // release
-			req := AcceptSyncFromLeaderRequest{me, currentRnd, sfx, syncidx}
-			if !peer.Call("OmniPaxos.AcceptSyncFromLeader", &req, &DummyReply{}) {
-				log.Info().Msgf("accept sync from leader failed %v %v",
-					me, args.Me)
-			}
-		}()
-
-		if decidedIdx > args.DecIdx {
-			go func() {
-				op.serializeCh <- struct{}{}        // acquire semaphore
-				defer func() { <-op.serializeCh }() // release
-				if !peer.Call("OmniPaxos.DecideFromLeader", &DecideFromLeaderRequest{me, currentRnd, decidedIdx}, &DummyReply{}) {
-					log.Info().Msgf("checkLeader(%v): no response from %v", op.R, args.Me)
-					return
-				}
-			}()
-		}
-
+		sfx := append([]any{}, op.suffix(syncidx)...)
+		op.sendAcceptSync(args.Me, AcceptSyncFromLeaderRequest{op.me, op.currentRnd, sfx, syncidx, op.decidedIdx, snapshot, snapshotIdx, sessions, 0, 0})
 	}
 }
 
 func (op *OmniPaxos) AcceptSyncFromLeader(args *AcceptSyncFromLeaderRequest, res *DummyReply) {
 	op.mu.Lock()
 
-	if op.promisedRnd != args.N || op.role != FOLLOWER || (op.phase != PREPARE && op.phase != RECOVER) {
+	if op.promisedRnd != args.N || op.role != FOLLOWER || (op.phase != PREPARE && op.phase != RECOVER) || op.distrusts(args.N) {
 		op.mu.Unlock()
 		return
 	}
 
+	if args.Chunks > 0 {
+		in := op.incoming
+		if in.n != args.N || in.xfer != args.Xfer || in.chunks != args.Chunks {
+			// incomplete transfer; ask the leader to start over
+			op.phase = RECOVER
+			op.mu.Unlock()
+			return
+		}
+		args.Snapshot = append(in.snapshot, args.Snapshot...)
+		args.Sfx = append(in.sfx, args.Sfx...)
+	}
+	op.incoming = syncTransfer{}
+
+	// a recovering follower can get a sync the leader sent for an
+	// earlier Prepare of this round, after a later one. Entries we have
+	// compacted since are decided, so the leader's are the same ones.
+	syncidx, sfx := args.Syncidx, args.Sfx
+	if skip := op.compactedIdx - syncidx; skip > 0 && args.SnapshotIdx <= op.compactedIdx {
+		syncidx, sfx = op.compactedIdx, sfx[min(skip, len(sfx)):]
+	}
+	if syncidx > op.logLen() && syncidx > args.SnapshotIdx {
+		// we dropped entries it does not carry; ask for a new sync
+		op.phase = RECOVER
+		op.mu.Unlock()
+		return
+	}
+	// what we accepted in this round is already the leader's log, and
+	// an older sync would only cut it short
+	keep := op.acceptedRnd == args.N && syncidx+len(sfx) < op.logLen()
+
 	op.acceptedRnd = args.N
 	op.role = FOLLOWER
 	op.phase = ACCEPT
 
-	op.log = op.prefix(args.Syncidx)
-	op.log = append(op.log, args.Sfx...)
+	// entries we proposed as leader are replaced from Syncidx on. The
+	// snapshot may replace them too, but could also hold the same ones.
+	op.failProposals(args.Syncidx, ErrOverwritten)
+	if args.SnapshotIdx > op.compactedIdx {
+		op.failProposals(op.decidedIdx, ErrLeaderChanged)
+		op.installSnapshot(args.Snapshot, args.SnapshotIdx, args.Sessions)
+	}
+	if !keep {
+		op.log = op.prefix(syncidx)
+		op.log = append(op.log, sfx...)
+	}
+	op.leaderDecIdx = max(op.leaderDecIdx, args.DecIdx)
+	op.advanceDecided()
+	op.persist()
 
-	leader := op.peers[args.Me]
-	logLen := len(op.log)
+	op.send(args.Me, &AcceptedFromFollowerRequest{op.me, args.N, op.logLen()})
 	op.mu.Unlock()
+}
 
-	go func() {
-		op.serializeCh <- struct{}{}        // acquire semaphore
-		defer func() { <-op.serializeCh }() // release
-		if !leader.Call("OmniPaxos.AcceptedFromFollower", &AcceptedFromFollowerRequest{op.me, args.N, logLen}, &DummyReply{}) {
-			log.Info().Msgf("fail to accept from leader %v => %v", op.R, args.Me)
-			return
-		}
-	}()
-
+// syncSnapshot returns our snapshot and the session table that goes with
+// it if a follower synchronizing from syncidx needs entries we have
+// compacted, and nil otherwise. The table is a copy: the message waits in
+// an outbox, and ours moves on as we compact.
+func (op *OmniPaxos) syncSnapshot(syncidx int) ([]byte, int, map[int64]Session) {
+	if syncidx >= op.compactedIdx {
+		return nil, 0, nil
+	}
+	return op.persister.ReadSnapshot(), op.compactedIdx, copySessions(op.snapSessions)
 }
@@ -1,14 +1,40 @@
 package omnipaxos
 
 import (
+	"time"
+
 	"github.com/rs/zerolog/log"
 )
 
+// The leader coalesces proposals into batches: a batch is sent as one
+// Accept when it reaches Config.AcceptBatchSize entries, or
+// Config.AcceptBatchWindow after its first entry was proposed.
+//
+// Decisions ride on the next batch: every Accept carries the leader's
+// decidedIdx. If no batch goes out within the batch window of a decision,
+// a separate Decide is sent instead, and idle heartbeats repeat it for
+// followers that missed it.
+
+// defaults for Config.AcceptBatchSize, Config.AcceptBatchWindow and
+// Config.BufferedProposalTimeout
+const (
+	acceptBatchSize         = 64
+	acceptBatchWindow       = 2 * time.Millisecond
+	bufferedProposalTimeout = 500 * time.Millisecond
+)
+
+// a command buffered during PREPARE, waiting for its index
+type bufferedProposal struct {
+	placed chan int            // receives the index, or -1 if it was dropped
+	future chan ProposalResult // from ProposeAsync, or nil
+}
+
 type AcceptFromLeaderRequest struct {
-	Me     int
-	N      BallotNumber
-	C      any
-	LogIdx int // Index where this entry should be placed
+	Me      int
+	N       BallotNumber
+	Entries []any
+	LogIdx  int // Index where the first entry should be placed
+	DecIdx  int // the leader's decidedIdx
 }
 
 type AcceptedFromFollowerRequest struct {
@@ -24,60 +50,92 @@ type DecideFromLeaderRequest struct {
 }
 
 // Called by the tester to submit a log to your OmniPaxos server
-// Implement this as described in Figure 3
+// Implement this as described in Figure 3. With forwarding on, a
+// follower relays the command to the leader (see forward.go).
+//
+// A leader still preparing its round buffers the command, and Proposal
+// blocks until the round starts and the index is known, for up to
+// Config.BufferedProposalTimeout (500ms by default). If the round takes
+// longer, the command is withdrawn and Proposal returns false.
 func (op *OmniPaxos) Proposal(command interface{}) (int, int, bool) {
-	op.serializeCh <- struct{}{}        // acquire semaphore
-	defer func() { <-op.serializeCh }() // release
+	if command == nil {
+		return -1, -1, false
+	}
+	if index, ballot, ok := op.propose(command); ok {
+		return index, ballot, ok
+	}
+	return op.forward(command)
+}
+
+// propose appends a command or a StopSign to the log
+func (op *OmniPaxos) propose(command any) (int, int, bool) {
+	// role and phase must not change between the check and the append
+	op.mu.Lock()
+	index, ballot, ok := op.appendProposal(command)
+	if !ok || index >= 0 {
+		op.mu.Unlock()
+		return index, ballot, ok
+	}
+	b := op.buffered[len(op.buffered)-1]
+	timeout := op.config.BufferedProposalTimeout
+	op.mu.Unlock()
+
+	select {
+	case index = <-b.placed:
+	case <-time.After(timeout):
+		op.mu.Lock()
+		op.withdrawBuffered(b)
+		op.mu.Unlock()
+		// -1 if it was still buffered, and the index if it just made it
+		index = <-b.placed
+	}
+	if index < 0 {
+		return -1, -1, false
+	}
+	return index, ballot, true
+}
+
+// appendProposal is propose without the locking. A command buffered
+// during PREPARE has index -1 until the round starts (see
+// placeBuffered). A nil command is refused: nil marks a hole in the log
+// (see receivedLen). Must hold op.mu.
+func (op *OmniPaxos) appendProposal(command any) (int, int, bool) {
 	log.Info().Msgf("Proposal being made!")
 	index := -1
 	ballot := -1
 	isLeader := false
 
 	// Your code here (A4).
-	if op.stopped() {
+	// a leader handing over leadership lets its log be decided first
+	if command == nil || op.stopped() || op.transferTarget >= 0 {
 		return index, ballot, isLeader
 	}
 
-	op.mu.Lock()
-	role := op.role
-	phase := op.phase
-	op.mu.Unlock()
-
-	if role == LEADER && phase == PREPARE {
-		op.mu.Lock()
-		defer op.mu.Unlock()
-		op.buffer = append(op.buffer, command)
+	if op.role == LEADER && op.phase == PREPARE {
+		// nothing may follow a buffered StopSign either
+		if n := len(op.buffer); n == 0 || !isStopSign(op.buffer[n-1]) {
+			op.buffer = append(op.buffer, command)
+			op.buffered = append(op.buffered, bufferedProposal{placed: make(chan int, 1)})
+			return index, op.B.Value, true
+		}
 	}
 
-	if role == LEADER && phase == ACCEPT {
-		log.Info().Msgf("[%v | %v] Proposal being made!", role, phase)
-		op.mu.Lock()
+	if op.role == LEADER && op.phase == ACCEPT {
+		log.Info().Msgf("[%v | %v] Proposal being made!", op.role, op.phase)
 		op.log = append(op.log, command)
-		op.accepted[op.me] = len(op.log)
-		index = len(op.log) - 1
-		// send Accept, curretnRnd, C to all promised followers
-		rnd := op.R
-		for _, promise := range op.promises {
-			i := promise.f
-			peer := op.peers[i]
-			if i == op.me {
-				continue
-			}
-			followerID := i
-			currentRnd := op.currentRnd
-			me := op.me
-			cmd := command
-			logIdx := index // Capture the index for this entry
-			go func() {
-				op.serializeCh <- struct{}{}        // acquire semaphore
-				defer func() { <-op.serializeCh }() // release
-				if !peer.Call("OmniPaxos.AcceptFromLeader", &AcceptFromLeaderRequest{me, currentRnd, cmd, logIdx}, &DummyReply{}) {
-					log.Info().Msgf("fail to accept from leader %v => %v", rnd, followerID)
-					return
-				}
-			}()
+		op.accepted[op.me] = op.logLen()
+		index = op.logLen() - 1
+		if op.logLen()-op.batchStart >= op.config.AcceptBatchSize {
+			op.flushAccepts()
+		} else if !op.flushPending {
+			op.flushPending = true
+			time.AfterFunc(op.config.AcceptBatchWindow, func() {
+				op.mu.Lock()
+				defer op.mu.Unlock()
+				op.flushPending = false
+				op.flushAccepts()
+			})
 		}
-		op.mu.Unlock()
 	}
 
 	if index != -1 {
@@ -88,44 +146,118 @@ func (op *OmniPaxos) Proposal(command interface{}) (int, int, bool) {
 	return index, ballot, isLeader
 }
 
+// placeBuffered appends the commands buffered during PREPARE to the log,
+// and tells their proposers where they went. Must hold op.mu.
+func (op *OmniPaxos) placeBuffered() {
+	start := op.logLen()
+	op.log = append(op.log, op.buffer...)
+	for i, b := range op.buffered {
+		b.placed <- start + i
+		if b.future != nil {
+			op.proposals[start+i] = pendingProposal{b.future, op.B.Value, digest(op.buffer[i])}
+		}
+	}
+	op.buffer = make([]any, 0)
+	op.buffered = nil
+}
+
+// dropBuffered discards the commands buffered during PREPARE, and fails
+// their proposals with err. Must hold op.mu.
+func (op *OmniPaxos) dropBuffered(err error) {
+	for _, b := range op.buffered {
+		b.placed <- -1
+		if b.future != nil {
+			b.future <- ProposalResult{Index: -1, Ballot: -1, Err: err}
+		}
+	}
+	op.buffer = make([]any, 0)
+	op.buffered = nil
+}
+
+// withdrawBuffered removes b's command from the buffer if it is still
+// there. Must hold op.mu.
+func (op *OmniPaxos) withdrawBuffered(b bufferedProposal) {
+	for i := range op.buffered {
+		if op.buffered[i].placed == b.placed {
+			op.buffer = append(op.buffer[:i:i], op.buffer[i+1:]...)
+			op.buffered = append(op.buffered[:i:i], op.buffered[i+1:]...)
+			b.placed <- -1
+			return
+		}
+	}
+}
+
+// flushAccepts sends the entries proposed since the last batch to all
+// promised followers in one Accept. Must hold op.mu.
+func (op *OmniPaxos) flushAccepts() {
+	if op.role != LEADER || op.phase != ACCEPT || op.batchStart >= op.logLen() {
+		return
+	}
+	// our own acceptance counts towards a decision once the followers
+	// reply, so it must be durable before we send
+	op.persist()
+
+	// send Accept, curretnRnd, C to all promised followers
+	entries := append([]any{}, op.suffix(op.batchStart)...)
+	req := AcceptFromLeaderRequest{op.me, op.currentRnd, entries, op.batchStart, op.decidedIdx}
+	op.batchStart = op.logLen()
+	op.sentDecIdx = op.decidedIdx
+	for _, promise := range op.promises {
+		if promise.f == op.me {
+			continue
+		}
+		if op.equivocate != nil {
+			forged := req
+			forged.Entries = op.equivocate(promise.f, entries)
+			op.send(promise.f, &forged)
+			continue
+		}
+		op.send(promise.f, &req)
+	}
+}
+
 // Follower 3.7
 func (op *OmniPaxos) AcceptFromLeader(args *AcceptFromLeaderRequest, res *DummyReply) {
-	op.serializeCh <- struct{}{}        // acquire semaphore
-	defer func() { <-op.serializeCh }() // release
 	log.Info().Msgf("Accept from leader!")
 	op.mu.Lock()
-	if op.promisedRnd != args.N || (op.role != FOLLOWER || op.phase != ACCEPT) {
+	if op.promisedRnd != args.N || (op.role != FOLLOWER || op.phase != ACCEPT) || op.distrusts(args.N) {
 		op.mu.Unlock()
 		return
 	}
 
-	// Ensure log has enough capacity for the entry at LogIdx
+	// Ensure log has enough capacity for the batch at LogIdx
 	// Fill with empty entries if needed
-	for len(op.log) <= args.LogIdx {
+	for op.logLen() < args.LogIdx+len(args.Entries) {
 		op.log = append(op.log, nil)
 	}
-	op.log[args.LogIdx] = args.C
+	for i, entry := range args.Entries {
+		// decided entries are already ours, and may have been compacted
+		// or cleaned since
+		if idx := args.LogIdx + i; idx >= max(op.compactedIdx, op.decidedIdx) {
+			op.log[idx-op.compactedIdx] = entry
+			op.recordDigest(args.Me, args.N, idx, entry)
+		}
+	}
+	if op.distrusts(args.N) {
+		// the leader sent us two different entries for the same index
+		op.mu.Unlock()
+		return
+	}
+	op.leaderDecIdx = max(op.leaderDecIdx, args.DecIdx)
+	op.advanceDecided()
+	op.persist()
 
-	logLen := len(op.log)
-	leader := op.peers[args.Me]
-	rnd := op.R
+	// only acknowledge entries we have actually received, so the leader
+	// never counts a hole towards a decision
+	op.send(args.Me, &AcceptedFromFollowerRequest{op.me, args.N, op.receivedLen()})
 	op.mu.Unlock()
-
-	go func() {
-		op.serializeCh <- struct{}{}        // acquire semaphore
-		defer func() { <-op.serializeCh }() // release
-		if !leader.Call("OmniPaxos.AcceptedFromFollower", &AcceptedFromFollowerRequest{op.me, args.N, logLen}, &DummyReply{}) {
-			log.Info().Msgf("fail to accept from leader %v => %v", rnd, args.Me)
-			return
-		}
-	}()
 }
 
 // Leader 3.8
 func (op *OmniPaxos) AcceptedFromFollower(args *AcceptedFromFollowerRequest, res *DummyReply) {
 	log.Info().Msgf("accepted from follower!")
 	op.mu.Lock()
-	if op.currentRnd != args.N || (op.role != LEADER && op.phase != ACCEPT) {
+	if op.currentRnd != args.N || op.role != LEADER || op.phase != ACCEPT {
 		op.mu.Unlock()
 		return
 	}
@@ -138,41 +270,51 @@ func (op *OmniPaxos) AcceptedFromFollower(args *AcceptedFromFollowerRequest, res
 		}
 	}
 
-	if args.LogIdx > op.decidedIdx && count > len(op.peers)/2 {
-		op.decidedIdx = args.LogIdx
-		peersToNotify := make([]int, 0)
-		for i := range op.peers {
-			if i != op.me {
-				peersToNotify = append(peersToNotify, i)
-			}
+	if args.LogIdx > op.decidedIdx && count > op.npeers/2 {
+		op.setDecided(args.LogIdx)
+		op.persist()
+		// leave the decision to the next batch, unless none goes out soon
+		if !op.decidePending {
+			op.decidePending = true
+			time.AfterFunc(op.config.AcceptBatchWindow, func() {
+				op.mu.Lock()
+				defer op.mu.Unlock()
+				op.decidePending = false
+				op.sendDecide()
+			})
 		}
-		decidedIdx := op.decidedIdx
-		currentRnd := op.currentRnd
-		rnd := op.R
-		op.mu.Unlock()
+	}
+	op.mu.Unlock()
+}
 
-		for _, i := range peersToNotify {
-			peer := op.peers[i]
-			go func(peerID int) {
-				op.serializeCh <- struct{}{}        // acquire semaphore
-				defer func() { <-op.serializeCh }() // release
-				if !peer.Call("OmniPaxos.DecideFromLeader", &DecideFromLeaderRequest{op.me, currentRnd, decidedIdx}, &DummyReply{}) {
-					log.Info().Msgf("checkLeader(%v): no response from %v", rnd, peerID)
-					return
-				}
-			}(i)
+// sendDecide tells the promised followers about decisions no Accept has
+// carried yet. Must hold op.mu.
+func (op *OmniPaxos) sendDecide() {
+	if op.role != LEADER || op.phase != ACCEPT || op.decidedIdx <= op.sentDecIdx {
+		return
+	}
+	op.sentDecIdx = op.decidedIdx
+	req := DecideFromLeaderRequest{op.me, op.currentRnd, op.decidedIdx}
+	// only promised followers can act on a Decide
+	for i := range op.promises {
+		if i != op.me {
+			op.send(i, &req)
 		}
-	} else {
-		op.mu.Unlock()
 	}
 }
 
 func (op *OmniPaxos) DecideFromLeader(args *DecideFromLeaderRequest, res *DummyReply) {
-	op.serializeCh <- struct{}{}        // acquire semaphore
-	defer func() { <-op.serializeCh }() // release
 	op.mu.Lock()
 	defer op.mu.Unlock()
-	if op.promisedRnd == args.N && op.role == FOLLOWER && op.phase == ACCEPT {
-		op.decidedIdx = args.DecIdx
+	op.learnDecided(args.N, args.DecIdx)
+}
+
+// learnDecided records that the leader of ballot n has decided up to
+// decIdx. Must hold op.mu.
+func (op *OmniPaxos) learnDecided(n BallotNumber, decIdx int) {
+	if op.promisedRnd == n && op.role == FOLLOWER && op.phase == ACCEPT && decIdx > op.leaderDecIdx && !op.distrusts(n) {
+		op.leaderDecIdx = decIdx
+		op.advanceDecided()
+		op.persist()
 	}
 }
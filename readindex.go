@@ -0,0 +1,115 @@
+package omnipaxos
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Linearizable reads without writing to the log. The leader notes the end
+// of its log, then checks that a majority still promises its currentRnd:
+// if so, no other leader can have decided anything the read would miss.
+// Once everything up to the noted index is decided, the service can read
+// its state as soon as it has applied that far.
+
+const readIndexTimeout = 500 * time.Millisecond
+
+type ConfirmLeaderRequest struct {
+	Me int
+	N  BallotNumber
+}
+
+type ConfirmLeaderReply struct {
+	Ok bool
+}
+
+// ReadIndex returns the index of the last entry a linearizable read must
+// observe, and whether this server could serve it as the leader. The
+// entry is decided; the service reads once it has applied it. The index
+// is -1 if the log is empty.
+func (op *OmniPaxos) ReadIndex() (int, bool) {
+	op.mu.Lock()
+	if op.role != LEADER || op.phase != ACCEPT {
+		op.mu.Unlock()
+		return -1, false
+	}
+	n := op.currentRnd
+	readIdx := op.logLen()
+	op.mu.Unlock()
+
+	if !op.confirmLeader(n) {
+		return -1, false
+	}
+	return op.waitDecided(n, readIdx)
+}
+
+// waitDecided waits until the entries before readIdx are decided, and
+// returns the index of the last one, while we remain the leader of n.
+func (op *OmniPaxos) waitDecided(n BallotNumber, readIdx int) (int, bool) {
+	// entries from earlier rounds may not be decided yet
+	timer := time.AfterFunc(readIndexTimeout, func() {
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		op.applyCond.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(readIndexTimeout)
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if readIdx == 0 {
+		// an empty log; decidedIdx stays -1 until something is decided
+		return -1, true
+	}
+	for op.decidedIdx < readIdx {
+		if op.killed() || op.currentRnd != n || op.role != LEADER || time.Now().After(deadline) {
+			return -1, false
+		}
+		op.applyCond.Wait()
+	}
+	return readIdx - 1, true
+}
+
+// confirmLeader asks the other servers whether they still promise n, and
+// returns true once a majority, counting us, does.
+func (op *OmniPaxos) confirmLeader(n BallotNumber) bool {
+	acks := make(chan bool, op.npeers)
+	for i := range op.npeers {
+		if i == op.me {
+			continue
+		}
+		i := i
+		go func() {
+			reply := ConfirmLeaderReply{}
+			if !op.transport.ConfirmLeader(i, &ConfirmLeaderRequest{op.me, n}, &reply) {
+				log.Info().Msgf("confirmLeader(%v): no response from %v", n, i)
+			}
+			acks <- reply.Ok
+		}()
+	}
+
+	timeout := time.After(readIndexTimeout)
+	confirmed, replies := 1, 1
+	for confirmed <= op.npeers/2 {
+		// give up once a majority can no longer be reached
+		if confirmed+op.npeers-replies <= op.npeers/2 {
+			return false
+		}
+		select {
+		case ok := <-acks:
+			replies++
+			if ok {
+				confirmed++
+			}
+		case <-timeout:
+			return false
+		}
+	}
+	return true
+}
+
+func (op *OmniPaxos) ConfirmLeader(args *ConfirmLeaderRequest, res *ConfirmLeaderReply) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	res.Ok = op.promisedRnd == args.N && !op.distrusts(args.N)
+}
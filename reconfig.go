@@ -0,0 +1,76 @@
+package omnipaxos
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reconfiguration (section 4 of the paper): the current configuration is
+// ended by deciding a StopSign in its log. Once a StopSign is in the log
+// nothing can be appended after it, and once it is decided the servers of
+// the next configuration start from the old log, continuing after it.
+
+// StopSign is the last entry of a configuration's log. It names the
+// servers of the next configuration; Metadata is opaque to OmniPaxos.
+type StopSign struct {
+	Peers    []int
+	Metadata []byte
+}
+
+func init() {
+	// StopSigns travel in []any log suffixes
+	gob.Register(StopSign{})
+}
+
+func isStopSign(entry any) bool {
+	_, ok := entry.(StopSign)
+	return ok
+}
+
+// Reconfigure proposes a StopSign that ends this configuration, handing
+// over to newPeers. Like Proposal, it returns the index the StopSign
+// will have if it is decided, the current ballot, and whether this
+// server is the leader. Once the StopSign is in the log, Proposal and
+// Reconfigure fail; the decided StopSign is sent on applyCh.
+func (op *OmniPaxos) Reconfigure(newPeers []int, metadata []byte) (int, int, bool) {
+	// gob decodes empty slices as nil, so store them that way for every
+	// server to hold the same StopSign
+	ss := StopSign{}
+	if len(newPeers) > 0 {
+		ss.Peers = append([]int{}, newPeers...)
+	}
+	if len(metadata) > 0 {
+		ss.Metadata = append([]byte{}, metadata...)
+	}
+	return op.propose(ss)
+}
+
+// NewConfigState returns the state a server of the next configuration
+// is started from, once this server has decided the StopSign: the
+// persisted state to save with SaveStateAndSnapshot before calling Make,
+// and the snapshot covering the compacted part of the log. The new
+// configuration's log continues after the StopSign.
+func (op *OmniPaxos) NewConfigState() ([]byte, []byte, bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if !op.stopped() || op.decidedIdx < op.logLen() {
+		return nil, nil, false
+	}
+
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	// ballots start over, the new configuration runs its own elections
+	state := persistentState{
+		Log:          op.log,
+		CompactedIdx: op.compactedIdx,
+		DecidedIdx:   op.decidedIdx,
+		ConfigIdx:    op.logLen(),
+	}
+	if err := e.Encode(state); err != nil {
+		log.Fatal().Msgf("[SERVER=%d] NewConfigState: %v", op.me, err)
+	}
+	return w.Bytes(), op.persister.ReadSnapshot(), true
+}
@@ -0,0 +1,71 @@
+package omnipaxos
+
+import "time"
+
+// Adaptive heartbeat timeout. A BLE round sends its heartbeats and, once
+// the heartbeat period is over, waits for the replies still out until a
+// timeout that follows the peers' round-trip times, so that a slow but
+// live peer's ballot is not missed and mistaken for a lost leader. Each
+// peer's round-trip time is smoothed as TCP does (RFC 6298). The timeout
+// is kept within [MinHeartbeatTimeout, MaxHeartbeatTimeout]: the minimum
+// absorbs a sudden slowdown the estimate has not caught up with yet, and
+// the maximum keeps a peer that never answers from stalling BLE. A reply
+// that still misses its round is counted in the next one.
+
+type rttEstimate struct {
+	srtt    time.Duration // smoothed round-trip time
+	rttvar  time.Duration // its mean deviation
+	samples int
+}
+
+// observeRTT folds a heartbeat round trip to pid into its estimate.
+// Must hold op.mu.
+func (op *OmniPaxos) observeRTT(pid int, rtt time.Duration) {
+	e := &op.rtts[pid]
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.samples++
+}
+
+// heartbeatTimeout is how long a round waits for replies: long enough
+// for the slowest peer we have heard from, within the configured bounds.
+// A round always lasts at least the heartbeat period. Must hold op.mu.
+func (op *OmniPaxos) heartbeatTimeout() time.Duration {
+	timeout := max(op.config.MinHeartbeatTimeout, op.delay)
+	for pid, e := range op.rtts {
+		if pid == op.me || e.samples == 0 {
+			continue
+		}
+		// leave room for a reply twice as slow as the average
+		timeout = max(timeout, e.srtt+max(4*e.rttvar, e.srtt))
+	}
+	return min(timeout, max(op.config.MaxHeartbeatTimeout, op.delay))
+}
+
+// HeartbeatTimeout returns how long the next BLE round will wait for
+// heartbeat replies
+func (op *OmniPaxos) HeartbeatTimeout() time.Duration {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.heartbeatTimeout()
+}
+
+// PeerRTT returns the smoothed heartbeat round-trip time to pid, or 0 if
+// pid has not answered a heartbeat yet
+func (op *OmniPaxos) PeerRTT(pid int) time.Duration {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if pid < 0 || pid >= len(op.rtts) {
+		return 0
+	}
+	return op.rtts[pid].srtt
+}
@@ -0,0 +1,112 @@
+package omnipaxos
+
+import "encoding/gob"
+
+// Client sessions give commands exactly-once semantics. A client numbers
+// its commands 1, 2, ... and proposes each as a SessionCommand, retrying
+// with the same Seq until it learns the outcome, possibly from another
+// leader. The first copy to be decided is applied; later copies are sent
+// on applyCh as duplicates, with neither CommandValid nor StopSignValid
+// set, like entries removed by log cleaning.
+//
+// The service caches each command's result with SetSessionResult, and
+// answers retries from SessionResult instead of proposing them again.
+// The session table is persisted as of the start of the log, alongside
+// the snapshot, and rebuilt from the log after a restart. Results must
+// be gob-encodable, and registered if they are not basic types.
+
+type SessionCommand struct {
+	ClientID int64
+	Seq      int64
+	Command  any
+}
+
+// Session is what the table remembers of a client: the Seq of its last
+// applied command and, once the service has set it, that command's result
+type Session struct {
+	Seq    int64
+	Result any
+}
+
+func init() {
+	gob.Register(SessionCommand{})
+}
+
+// sessionOf returns the client and Seq of a session command, including
+// one that log cleaning has replaced
+func sessionOf(entry any) (int64, int64, bool) {
+	switch e := entry.(type) {
+	case SessionCommand:
+		return e.ClientID, e.Seq, true
+	case cleaned:
+		return e.ClientID, e.Seq, e.Seq > 0
+	}
+	return 0, 0, false
+}
+
+// applySession records entry in table, and returns false if it is a
+// duplicate of a command the table has already seen
+func applySession(table map[int64]Session, entry any) bool {
+	id, seq, ok := sessionOf(entry)
+	if !ok {
+		return true
+	}
+	if seq <= table[id].Seq {
+		return false
+	}
+	table[id] = Session{Seq: seq}
+	return true
+}
+
+func copySessions(table map[int64]Session) map[int64]Session {
+	c := make(map[int64]Session, len(table))
+	for id, s := range table {
+		c[id] = s
+	}
+	return c
+}
+
+// advanceSnapSessions brings the persisted session table up to the
+// entries before idx, which are about to be compacted. Must hold op.mu.
+func (op *OmniPaxos) advanceSnapSessions(idx int) {
+	for i := op.compactedIdx; i < idx; i++ {
+		applySession(op.snapSessions, op.log[i-op.compactedIdx])
+	}
+	// a client only retries its last command, so that is the only
+	// result worth keeping
+	for id, s := range op.snapSessions {
+		if live := op.sessions[id]; live.Seq == s.Seq && live.Result != nil {
+			s.Result = live.Result
+			op.snapSessions[id] = s
+		}
+	}
+}
+
+// SetSessionResult caches the result of the client's command seq, once the
+// service has applied it. Only the client's last command is cached.
+func (op *OmniPaxos) SetSessionResult(clientID int64, seq int64, result any) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if s, ok := op.sessions[clientID]; ok && s.Seq == seq {
+		s.Result = result
+		op.sessions[clientID] = s
+	}
+}
+
+// SessionResult reports whether the client's command seq has been
+// applied, and its cached result if it is the client's last command and
+// the service has set one.
+func (op *OmniPaxos) SessionResult(clientID int64, seq int64) (any, bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	s := op.sessions[clientID]
+	if seq > s.Seq {
+		return nil, false
+	}
+	if seq < s.Seq {
+		return nil, true
+	}
+	return s.Result, true
+}
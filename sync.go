@@ -0,0 +1,82 @@
+package omnipaxos
+
+// A follower that is far behind may need a snapshot and a long log suffix
+// to catch up. Rather than shipping them in a single AcceptSync, the leader
+// streams them ahead of it in chunks; the AcceptSync then carries only the
+// last chunk, and the follower assembles the rest from what it has staged.
+
+// defaults for Config.SnapshotChunkBytes and Config.SyncChunkEntries
+const (
+	snapshotChunkBytes = 16 * 1024
+	syncChunkEntries   = 256
+)
+
+type SyncChunkFromLeaderRequest struct {
+	Me       int
+	N        BallotNumber
+	Xfer     int    // transfer this chunk belongs to
+	Seq      int    // position of this chunk in the transfer
+	Snapshot []byte // next piece of the snapshot, if any
+	Sfx      []any  // next piece of the suffix, if any
+}
+
+// syncTransfer is a chunked AcceptSync being received from the leader
+type syncTransfer struct {
+	n        BallotNumber
+	xfer     int
+	chunks   int
+	snapshot []byte
+	sfx      []any
+	seen     int // chunks at the end of the last round, to spot a stall
+}
+
+// sendAcceptSync sends req to follower pid, streaming the snapshot and a
+// long suffix ahead of it in chunks. Must hold op.mu.
+func (op *OmniPaxos) sendAcceptSync(pid int, req AcceptSyncFromLeaderRequest) {
+	op.syncXfer++
+	xfer := op.syncXfer
+
+	var chunks []SyncChunkFromLeaderRequest
+	snapshot, sfx := req.Snapshot, req.Sfx
+	for len(snapshot) > op.config.SnapshotChunkBytes {
+		chunks = append(chunks, SyncChunkFromLeaderRequest{Snapshot: snapshot[:op.config.SnapshotChunkBytes]})
+		snapshot = snapshot[op.config.SnapshotChunkBytes:]
+	}
+	for len(sfx) > op.config.SyncChunkEntries {
+		chunks = append(chunks, SyncChunkFromLeaderRequest{Snapshot: snapshot, Sfx: sfx[:op.config.SyncChunkEntries]})
+		snapshot = nil
+		sfx = sfx[op.config.SyncChunkEntries:]
+	}
+	for i := range chunks {
+		chunks[i].Me, chunks[i].N, chunks[i].Xfer, chunks[i].Seq = req.Me, req.N, xfer, i
+	}
+	req.Snapshot, req.Sfx = snapshot, sfx
+	req.Xfer, req.Chunks = xfer, len(chunks)
+
+	// the queue to pid keeps the chunks in order, and drops the rest of
+	// the transfer if one of them fails
+	for i := range chunks {
+		op.send(pid, &chunks[i])
+	}
+	op.send(pid, &req)
+}
+
+// Follower stages a chunk of an AcceptSync
+func (op *OmniPaxos) SyncChunkFromLeader(args *SyncChunkFromLeaderRequest, res *DummyReply) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if op.promisedRnd != args.N || op.role != FOLLOWER || (op.phase != PREPARE && op.phase != RECOVER) {
+		return
+	}
+	if args.Seq == 0 {
+		op.incoming = syncTransfer{n: args.N, xfer: args.Xfer}
+	} else if op.incoming.n != args.N || op.incoming.xfer != args.Xfer || op.incoming.chunks != args.Seq {
+		// a chunk of this transfer went missing, or another transfer
+		// has started since; the AcceptSync will be rejected
+		return
+	}
+	op.incoming.snapshot = append(op.incoming.snapshot, args.Snapshot...)
+	op.incoming.sfx = append(op.incoming.sfx, args.Sfx...)
+	op.incoming.chunks++
+}
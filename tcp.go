@@ -0,0 +1,429 @@
+package omnipaxos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TCP transport, for servers in different processes. Each server listens
+// on its own address, and keeps one connection open to every peer it
+// sends to, redialing with exponential backoff after it breaks. Messages
+// are frames of a 4-byte big-endian length followed by a gob-encoded
+// tcpFrame. Every message is answered, the one-way ones with an empty
+// reply once handled, so a send returns after the peer has processed the
+// message, as it does over labrpc; replies are matched to requests by
+// ID, so calls to a peer share its connection.
+
+const (
+	tcpCallTimeout = 2 * time.Second // until a call without a reply fails
+	tcpMinBackoff  = 50 * time.Millisecond
+	tcpMaxBackoff  = 2 * time.Second
+	tcpMaxFrame    = 64 << 20
+)
+
+type tcpFrame struct {
+	ID     uint64
+	Method string // empty in replies
+	Body   []byte
+}
+
+func writeFrame(w io.Writer, f *tcpFrame) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		return err
+	}
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (*tcpFrame, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > tcpMaxFrame {
+		return nil, fmt.Errorf("frame of %v bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	f := &tcpFrame{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// message bodies. DummyReply has no fields for gob to encode, and is sent
+// as an empty body.
+func encodeBody(v any) ([]byte, error) {
+	if _, ok := v.(*DummyReply); ok {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBody(body []byte, v any) error {
+	if _, ok := v.(*DummyReply); ok {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(v)
+}
+
+type tcpHandler func(op *OmniPaxos, body []byte) ([]byte, error)
+
+func handle[A any, R any](h func(*OmniPaxos, *A, *R)) tcpHandler {
+	return func(op *OmniPaxos, body []byte) ([]byte, error) {
+		args, reply := new(A), new(R)
+		if err := decodeBody(body, args); err != nil {
+			return nil, err
+		}
+		h(op, args, reply)
+		return encodeBody(reply)
+	}
+}
+
+var tcpHandlers = map[string]tcpHandler{
+	"Prepare":                   handle((*OmniPaxos).RecievePrepare),
+	"Promise":                   handle((*OmniPaxos).PromiseFromFollower),
+	"AcceptSync":                handle((*OmniPaxos).AcceptSyncFromLeader),
+	"SyncChunk":                 handle((*OmniPaxos).SyncChunkFromLeader),
+	"Accept":                    handle((*OmniPaxos).AcceptFromLeader),
+	"Accepted":                  handle((*OmniPaxos).AcceptedFromFollower),
+	"Decide":                    handle((*OmniPaxos).DecideFromLeader),
+	"PrepareRecoveringFollower": handle((*OmniPaxos).PrepareRecoveringFollower),
+	"TakeLeadership":            handle((*OmniPaxos).TakeLeadership),
+	"HB":                        handle((*OmniPaxos).ReceiveHBRequest),
+	"PreVote":                   handle((*OmniPaxos).PreVote),
+	"ConfirmLeader":             handle((*OmniPaxos).ConfirmLeader),
+	"ForwardProposal":           handle((*OmniPaxos).ForwardProposal),
+}
+
+var errConnClosed = errors.New("connection closed")
+
+// tcpConn is a connection to a peer, shared by all calls to it
+type tcpConn struct {
+	conn net.Conn
+	wmu  sync.Mutex // one frame written at a time
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *tcpFrame // calls waiting for their reply
+	closed  bool
+}
+
+// call sends a request and waits for its reply
+func (c *tcpConn) call(method string, body []byte) (*tcpFrame, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errConnClosed
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan *tcpFrame, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(tcpCallTimeout))
+	err := writeFrame(c.conn, &tcpFrame{ID: id, Method: method, Body: body})
+	c.wmu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		return reply, nil
+	case <-time.After(tcpCallTimeout):
+		return nil, fmt.Errorf("%v timed out", method)
+	}
+}
+
+// readReplies hands each reply to the call waiting for it, until the
+// connection breaks
+func (c *tcpConn) readReplies() {
+	r := bufio.NewReader(c.conn)
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			c.close()
+			return
+		}
+		c.mu.Lock()
+		if ch, ok := c.pending[f.ID]; ok {
+			ch <- f
+		}
+		c.mu.Unlock()
+	}
+}
+
+// close fails the calls still waiting
+func (c *tcpConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *tcpConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+type tcpPeer struct {
+	mu      sync.Mutex
+	addr    string
+	conn    *tcpConn
+	backoff time.Duration // after the last failed dial
+	retryAt time.Time     // no dialing before this
+}
+
+// TCPTransport connects a server to its peers over TCP. addrs holds
+// every server's address, indexed by pid.
+type TCPTransport struct {
+	me    int
+	peers []*tcpPeer
+
+	mu       sync.Mutex
+	listener net.Listener
+	accepted map[net.Conn]bool
+	closed   bool
+}
+
+func NewTCPTransport(me int, addrs []string) *TCPTransport {
+	t := &TCPTransport{me: me, accepted: make(map[net.Conn]bool)}
+	for _, addr := range addrs {
+		t.peers = append(t.peers, &tcpPeer{addr: addr})
+	}
+	return t
+}
+
+// Serve answers the peers' messages to op on l, until Close
+func (t *TCPTransport) Serve(l net.Listener, op *OmniPaxos) {
+	t.mu.Lock()
+	t.listener = l
+	t.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Info().Msgf("[SERVER=%d] stopped listening: %v", t.me, err)
+				return
+			}
+			t.mu.Lock()
+			if t.closed {
+				t.mu.Unlock()
+				conn.Close()
+				return
+			}
+			t.accepted[conn] = true
+			t.mu.Unlock()
+			go t.serveConn(conn, op)
+		}
+	}()
+}
+
+func (t *TCPTransport) serveConn(conn net.Conn, op *OmniPaxos) {
+	defer func() {
+		conn.Close()
+		t.mu.Lock()
+		delete(t.accepted, conn)
+		t.mu.Unlock()
+	}()
+
+	wmu := sync.Mutex{}
+	r := bufio.NewReader(conn)
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		h, ok := tcpHandlers[f.Method]
+		if !ok {
+			log.Warn().Msgf("[SERVER=%d] unknown message %q", t.me, f.Method)
+			return
+		}
+		go func() {
+			body, err := h(op, f.Body)
+			if err != nil {
+				log.Warn().Msgf("[SERVER=%d] bad %v message: %v", t.me, f.Method, err)
+				conn.Close()
+				return
+			}
+			wmu.Lock()
+			defer wmu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(tcpCallTimeout))
+			if err := writeFrame(conn, &tcpFrame{ID: f.ID, Body: body}); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Close stops serving, and closes the connections to and from peers
+func (t *TCPTransport) Close() {
+	t.mu.Lock()
+	t.closed = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	for conn := range t.accepted {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	for _, p := range t.peers {
+		p.mu.Lock()
+		if p.conn != nil {
+			p.conn.close()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// conn returns the connection to peer, dialing it if it is not open, or
+// nil while we back off from a failed dial
+func (t *TCPTransport) conn(peer int) *tcpConn {
+	p := t.peers[peer]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && !p.conn.isClosed() {
+		return p.conn
+	}
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed || time.Now().Before(p.retryAt) {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", p.addr, tcpCallTimeout)
+	if err != nil {
+		p.backoff = min(max(2*p.backoff, tcpMinBackoff), tcpMaxBackoff)
+		p.retryAt = time.Now().Add(p.backoff)
+		log.Info().Msgf("[SERVER=%d] cannot reach %v at %v, retrying in %v: %v", t.me, peer, p.addr, p.backoff, err)
+		return nil
+	}
+	p.backoff = 0
+	p.conn = &tcpConn{conn: conn, pending: make(map[uint64]chan *tcpFrame)}
+	go p.conn.readReplies()
+	return p.conn
+}
+
+func (t *TCPTransport) call(peer int, method string, args any, reply any) bool {
+	c := t.conn(peer)
+	if c == nil {
+		return false
+	}
+	body, err := encodeBody(args)
+	if err != nil {
+		log.Error().Msgf("[SERVER=%d] cannot encode %v: %v", t.me, method, err)
+		return false
+	}
+	f, err := c.call(method, body)
+	if err != nil {
+		log.Info().Msgf("[SERVER=%d] %v to %v failed: %v", t.me, method, peer, err)
+		return false
+	}
+	if err := decodeBody(f.Body, reply); err != nil {
+		log.Error().Msgf("[SERVER=%d] cannot decode %v reply: %v", t.me, method, err)
+		return false
+	}
+	return true
+}
+
+func (t *TCPTransport) Peers() int {
+	return len(t.peers)
+}
+
+func (t *TCPTransport) Prepare(peer int, args *PrepareRequest) bool {
+	return t.call(peer, "Prepare", args, &DummyReply{})
+}
+
+func (t *TCPTransport) Promise(peer int, args *PromiseFromFollowerRequest) bool {
+	return t.call(peer, "Promise", args, &DummyReply{})
+}
+
+func (t *TCPTransport) AcceptSync(peer int, args *AcceptSyncFromLeaderRequest) bool {
+	return t.call(peer, "AcceptSync", args, &DummyReply{})
+}
+
+func (t *TCPTransport) SyncChunk(peer int, args *SyncChunkFromLeaderRequest) bool {
+	return t.call(peer, "SyncChunk", args, &DummyReply{})
+}
+
+func (t *TCPTransport) Accept(peer int, args *AcceptFromLeaderRequest) bool {
+	return t.call(peer, "Accept", args, &DummyReply{})
+}
+
+func (t *TCPTransport) Accepted(peer int, args *AcceptedFromFollowerRequest) bool {
+	return t.call(peer, "Accepted", args, &DummyReply{})
+}
+
+func (t *TCPTransport) Decide(peer int, args *DecideFromLeaderRequest) bool {
+	return t.call(peer, "Decide", args, &DummyReply{})
+}
+
+func (t *TCPTransport) PrepareRecoveringFollower(peer int, args *PrepareRecoveringFollowerRequest) bool {
+	return t.call(peer, "PrepareRecoveringFollower", args, &DummyReply{})
+}
+
+func (t *TCPTransport) TakeLeadership(peer int, args *TakeLeadershipRequest) bool {
+	return t.call(peer, "TakeLeadership", args, &DummyReply{})
+}
+
+func (t *TCPTransport) HB(peer int, args *HBRequest, reply *HBReply) bool {
+	return t.call(peer, "HB", args, reply)
+}
+
+func (t *TCPTransport) PreVote(peer int, args *PreVoteRequest, reply *PreVoteReply) bool {
+	return t.call(peer, "PreVote", args, reply)
+}
+
+func (t *TCPTransport) ConfirmLeader(peer int, args *ConfirmLeaderRequest, reply *ConfirmLeaderReply) bool {
+	return t.call(peer, "ConfirmLeader", args, reply)
+}
+
+func (t *TCPTransport) ForwardProposal(peer int, args *ForwardProposalRequest, reply *ForwardProposalReply) bool {
+	return t.call(peer, "ForwardProposal", args, reply)
+}
@@ -13,10 +13,18 @@ package omnipaxos
 // 	-loglevel [n] (this will set the log level accordingly)
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"flag"
 	"math/rand"
+	"net"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -322,6 +330,254 @@ func TestFigure5cChained3(t *testing.T) {
 
 }
 
+// A server given a higher priority takes over from the current leader,
+// and again after it rejoins, but cannot win without a quorum.
+func TestLeaderPriority3(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (3): [TestLeaderPriority3] preferred leader")
+
+	leader1 := cfg.checkOneLeader()
+	preferred := (leader1 + 1) % servers
+	cfg.paxos[preferred].SetPriority(1)
+	if leader := cfg.checkOneLeader(); leader != preferred {
+		t.Fatalf("preferred server %v did not take over from %v", preferred, leader)
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	// the others carry on without it, and it takes over again once it
+	// is back
+	cfg.disconnect(preferred)
+	cfg.one(rand.Int(), servers-1, true)
+	cfg.connect(preferred)
+	time.Sleep(PaxosElectionTimeout)
+	if leader := cfg.checkOneLeader(); leader != preferred {
+		t.Fatalf("preferred server %v did not take over from %v after rejoining", preferred, leader)
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	// priority does not make up for a lost quorum (Fig 5a)
+	for i := 0; i < servers; i++ {
+		cfg.disconnect(i)
+	}
+	S := (preferred + 1) % servers
+	var all []int
+	for i := 0; i < servers; i++ {
+		all = append(all, i)
+	}
+	cfg.partiallyConnect(S, all)
+	time.Sleep(2 * PaxosElectionTimeout)
+	if leader := cfg.checkOneLeader(); leader != S {
+		t.Fatalf("server %v is the only server with QC, yet got %v as a leader", S, leader)
+	}
+
+	cfg.end()
+}
+
+func TestConfigValidate3(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	bad := []func(*Config){
+		func(c *Config) { c.HeartbeatPeriod = 0 },
+		func(c *Config) { c.MinHeartbeatTimeout = -time.Millisecond },
+		func(c *Config) { c.MaxHeartbeatTimeout = c.MinHeartbeatTimeout - 1 },
+		func(c *Config) { c.LinkDropRounds = 0 },
+		func(c *Config) { c.ReconnectRounds = 0 },
+		func(c *Config) { c.LeaseDuration = -time.Millisecond },
+		func(c *Config) { c.AcceptBatchSize = 0 },
+		func(c *Config) { c.AcceptBatchWindow = -time.Millisecond },
+		func(c *Config) { c.BufferedProposalTimeout = 0 },
+		func(c *Config) { c.ApplyBatchSize = -1 },
+		func(c *Config) { c.SyncChunkEntries = 0 },
+		func(c *Config) { c.SnapshotChunkBytes = 0 },
+	}
+	for i, f := range bad {
+		c := DefaultConfig()
+		f(&c)
+		if op, err := MakeWithConfig(nil, 0, MakePersister(), nil, c); err == nil || op != nil {
+			t.Fatalf("invalid config %v was accepted: %+v", i, c)
+		}
+	}
+}
+
+// measureFailover disconnects the leader, and returns how many BLE
+// rounds the others take to elect a new one
+func measureFailover(t *testing.T, cfg *config) int {
+	rounds := func(i int) int {
+		cfg.paxos[i].mu.Lock()
+		defer cfg.paxos[i].mu.Unlock()
+		return cfg.paxos[i].R
+	}
+	leader := cfg.checkOneLeader()
+	ballot, _ := cfg.paxos[leader].GetState()
+	r0 := make([]int, cfg.n)
+	for i := 0; i < cfg.n; i++ {
+		r0[i] = rounds(i)
+	}
+	cfg.disconnect(leader)
+	for t0 := time.Now(); time.Since(t0) < 5*time.Second; time.Sleep(time.Millisecond) {
+		for i := 0; i < cfg.n; i++ {
+			if b, ok := cfg.paxos[i].GetState(); i != leader && ok && b > ballot {
+				elapsed := rounds(i) - r0[i]
+				cfg.connect(leader)
+				return elapsed
+			}
+		}
+	}
+	t.Fatalf("no leader elected after %v disconnected", leader)
+	return 0
+}
+
+// Thresholds are counted in heartbeat rounds, so a cluster with fast
+// heartbeats fails over faster.
+func TestFastTimers3(t *testing.T) {
+	servers := 3
+	paxosConfig := DefaultConfig()
+	paxosConfig.HeartbeatPeriod = 20 * time.Millisecond
+	paxosConfig.LeaseDuration = 50 * time.Millisecond
+	paxosConfig.AcceptBatchSize = 8
+	paxosConfig.ApplyBatchSize = 4
+	cfg := makeConfigWith(t, servers, false, false, paxosConfig)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (3): [TestFastTimers3] fast heartbeats")
+
+	cfg.one(rand.Int(), servers, true)
+
+	rounds := func() int {
+		cfg.paxos[0].mu.Lock()
+		defer cfg.paxos[0].mu.Unlock()
+		return cfg.paxos[0].R
+	}
+	r0 := rounds()
+	time.Sleep(time.Second)
+	if r := rounds() - r0; r < int(time.Second/paxosConfig.HeartbeatPeriod)/2 {
+		t.Fatalf("%v heartbeat rounds in 1s with a %v period", r, paxosConfig.HeartbeatPeriod)
+	}
+
+	// the leader is missed in the first round it does not answer, and
+	// the pre-vote and election take a round each; a few more allow for
+	// a disconnect in the middle of a round
+	iters := 5
+	for i := 0; i < iters; i++ {
+		if r := measureFailover(t, cfg); r > 6 {
+			t.Fatalf("failover took %v heartbeat rounds", r)
+		}
+		for i := 0; i < 20; i++ {
+			cfg.one(rand.Int(), servers, true)
+		}
+	}
+
+	cfg.end()
+}
+
+// leaderChanges slows down every request to the leader step by step, as
+// a congested link would, until its replies miss their round and the
+// next, and counts how often leadership moves. It also returns how long
+// a follower then waits for heartbeat replies.
+func leaderChanges(t *testing.T, description string, paxosConfig Config) (int, time.Duration) {
+	servers := 5
+	cfg := makeConfigWith(t, servers, false, false, paxosConfig)
+	defer cfg.cleanup()
+
+	cfg.begin(description)
+
+	leader := cfg.checkOneLeader()
+	ballot, _ := cfg.paxos[leader].GetState()
+	changes := 0
+	for _, ms := range []time.Duration{40, 80, 120, 160, 200, 240} {
+		cfg.net.Latency(leader, ms*time.Millisecond)
+		for t0 := time.Now(); time.Since(t0) < time.Second; time.Sleep(10 * time.Millisecond) {
+			for i := 0; i < servers; i++ {
+				if b, ok := cfg.paxos[i].GetState(); ok && b > ballot {
+					ballot = b
+					changes++
+				}
+			}
+		}
+	}
+	timeout := cfg.paxos[(leader+1)%servers].HeartbeatTimeout()
+
+	cfg.end()
+	return changes, timeout
+}
+
+// A leader that answers heartbeats more slowly than the heartbeat period
+// is alive, and keeps leadership once the timeout adapts to it.
+func TestAdaptiveHeartbeat3(t *testing.T) {
+	fixed := DefaultConfig()
+	fixed.MinHeartbeatTimeout = fixed.HeartbeatPeriod
+	fixed.MaxHeartbeatTimeout = fixed.HeartbeatPeriod
+	changes, _ := leaderChanges(t, "Test (3): [TestAdaptiveHeartbeat3] slow leader, fixed heartbeat timeout", fixed)
+	if changes == 0 {
+		t.Fatalf("a leader slower than the heartbeat timeout kept leadership")
+	}
+
+	// no slack beyond the heartbeat period but what the estimate gives
+	adaptive := DefaultConfig()
+	adaptive.MinHeartbeatTimeout = adaptive.HeartbeatPeriod
+	adaptive.MaxHeartbeatTimeout = 500 * time.Millisecond
+	changes, timeout := leaderChanges(t, "Test (3): [TestAdaptiveHeartbeat3] slow leader, adaptive heartbeat timeout", adaptive)
+	if changes > 0 {
+		t.Fatalf("leadership moved %v times away from a slow but live leader", changes)
+	}
+	if timeout <= adaptive.HeartbeatPeriod || timeout > adaptive.MaxHeartbeatTimeout {
+		t.Fatalf("heartbeat timeout %v with a 240ms leader, want within (%v, %v]",
+			timeout, adaptive.HeartbeatPeriod, adaptive.MaxHeartbeatTimeout)
+	}
+}
+
+// A follower whose link to the leader keeps dropping for a round or so
+// is turned down in the pre-vote, and leaves the ballots alone.
+func TestPreVoteFlappingLink3(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (3): [TestPreVoteFlappingLink3] flapping link to the leader")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	flapper := (leader + 1) % servers
+	incs := cfg.ballotIncrements()
+	for i := 0; i < 10; i++ {
+		cfg.partiallyDisconnect(flapper, []int{leader})
+		time.Sleep(120 * time.Millisecond)
+		cfg.partiallyConnect(flapper, []int{leader})
+		time.Sleep(300 * time.Millisecond)
+	}
+	if n := cfg.ballotIncrements() - incs; n > 0 {
+		t.Fatalf("a flapping link raised the ballots %v times", n)
+	}
+	if stats := cfg.paxos[flapper].BLEStats(); stats.PreVotes == 0 {
+		t.Fatalf("server %v never missed the leader", flapper)
+	}
+	if l := cfg.checkOneLeader(); l != leader {
+		t.Fatalf("leadership moved from %v to %v", leader, l)
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	// cut off from everyone, the flapper loses its quorum. Back in touch
+	// with a live leader it holds no pre-vote, but is quorum-connected
+	// again, and a candidate once the leader goes.
+	cfg.disconnect(flapper)
+	time.Sleep(500 * time.Millisecond)
+	cfg.connect(flapper)
+	time.Sleep(500 * time.Millisecond)
+	cfg.paxos[flapper].mu.Lock()
+	qc := cfg.paxos[flapper].qc
+	cfg.paxos[flapper].mu.Unlock()
+	if !qc {
+		t.Fatalf("server %v is not quorum-connected after it reconnected", flapper)
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
 // elect a leader
 // sleep for some time to reach a stable state
 // submit 3 commands
@@ -352,6 +608,312 @@ func TestBasicAgree4(t *testing.T) {
 	cfg.end()
 }
 
+// awaitApplied reads ch until cmd is applied
+func awaitApplied(ch <-chan ApplyMsg, cmd int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-ch:
+			if m.CommandValid && m.Command == cmd {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// agreeOver proposes cmd until every server but down has applied it, for
+// servers that are not run by the tester
+func agreeOver(t *testing.T, paxos []*OmniPaxos, applyChs []chan ApplyMsg, cmd int, down int) {
+	for t0 := time.Now(); time.Since(t0) < 10*time.Second; {
+		for i := range paxos {
+			if i == down {
+				continue
+			}
+			if _, _, ok := paxos[i].Proposal(cmd); !ok {
+				continue
+			}
+			applied := true
+			for j := range paxos {
+				if j != down && !awaitApplied(applyChs[j], cmd, 2*time.Second) {
+					applied = false
+					break
+				}
+			}
+			if applied {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%v was not applied", cmd)
+}
+
+// The protocol runs over any Transport, here one that calls the other
+// servers' handlers directly.
+func TestLocalNetwork4(t *testing.T) {
+	servers := 3
+	network := NewLocalNetwork(servers)
+	paxos := make([]*OmniPaxos, servers)
+	applyChs := make([]chan ApplyMsg, servers)
+	for i := range servers {
+		// messages to a server that is not registered yet are lost
+		network.Connect(i, true)
+	}
+	start := func(i int) {
+		applyChs[i] = make(chan ApplyMsg, 100)
+		op, err := MakeWithTransport(network.Transport(i), i, MakePersister(), applyChs[i], DefaultConfig())
+		if err != nil {
+			t.Fatalf("MakeWithTransport: %v", err)
+		}
+		paxos[i] = op
+		network.Register(i, op)
+	}
+	defer func() {
+		for _, op := range paxos {
+			if op != nil {
+				op.Kill()
+			}
+		}
+	}()
+
+	late := servers - 1
+	for i := range late {
+		start(i)
+	}
+	agreeOver(t, paxos, applyChs, 100, late)
+	start(late)
+	if !awaitApplied(applyChs[late], 100, 5*time.Second) {
+		t.Fatalf("server %v did not catch up after registering", late)
+	}
+
+	agreeOver(t, paxos, applyChs, 101, -1)
+	leader := -1
+	for i := range servers {
+		if _, isLeader := paxos[i].GetState(); isLeader {
+			leader = i
+		}
+	}
+	if leader < 0 {
+		t.Fatalf("no leader after an agreement")
+	}
+
+	// the others elect a new leader without the old one
+	network.Connect(leader, false)
+	agreeOver(t, paxos, applyChs, 102, leader)
+
+	// and bring it up to date once it is back
+	network.Connect(leader, true)
+	if !awaitApplied(applyChs[leader], 102, 5*time.Second) {
+		t.Fatalf("server %v did not catch up after reconnecting", leader)
+	}
+	agreeOver(t, paxos, applyChs, 103, -1)
+}
+
+// Three servers on loopback ports, one of which is restarted: the others
+// reconnect to it once it is back.
+func TestTCPTransport4(t *testing.T) {
+	servers := 3
+	addrs := make([]string, servers)
+	listeners := make([]net.Listener, servers)
+	for i := range servers {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	transports := make([]*TCPTransport, servers)
+	paxos := make([]*OmniPaxos, servers)
+	applyChs := make([]chan ApplyMsg, servers)
+	persisters := make([]*Persister, servers)
+	start := func(i int, l net.Listener) {
+		transports[i] = NewTCPTransport(i, addrs)
+		applyChs[i] = make(chan ApplyMsg, 100)
+		op, err := MakeWithTransport(transports[i], i, persisters[i], applyChs[i], DefaultConfig())
+		if err != nil {
+			t.Fatalf("MakeWithTransport: %v", err)
+		}
+		paxos[i] = op
+		transports[i].Serve(l, op)
+	}
+	stop := func(i int) {
+		paxos[i].Kill()
+		transports[i].Close()
+	}
+	for i := range servers {
+		persisters[i] = MakePersister()
+		start(i, listeners[i])
+	}
+	defer func() {
+		for i := range servers {
+			stop(i)
+		}
+	}()
+
+	agreeOver(t, paxos, applyChs, 101, -1)
+	leader := -1
+	for i := range servers {
+		if _, isLeader := paxos[i].GetState(); isLeader {
+			leader = i
+		}
+	}
+	if leader < 0 {
+		t.Fatalf("no leader after an agreement")
+	}
+
+	stop(leader)
+	agreeOver(t, paxos, applyChs, 102, leader)
+
+	l, err := net.Listen("tcp", addrs[leader])
+	if err != nil {
+		t.Fatalf("listen again on %v: %v", addrs[leader], err)
+	}
+	persisters[leader] = persisters[leader].Copy()
+	start(leader, l)
+	if !awaitApplied(applyChs[leader], 102, 5*time.Second) {
+		t.Fatalf("server %v did not catch up after restarting", leader)
+	}
+	agreeOver(t, paxos, applyChs, 103, -1)
+}
+
+// Copies of an entry have the same digest, however it reached the server,
+// even if it holds pointers and maps.
+func TestEntryDigest4(t *testing.T) {
+	type inner struct {
+		N int
+	}
+	type command struct {
+		Key   string
+		Ptr   *inner
+		Tags  map[string]int
+		Items []any
+	}
+	gob.Register(command{})
+	orig := command{"k", &inner{7}, map[string]int{"a": 1, "b": 2, "c": 3}, []any{1, "x"}}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&[]any{orig}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var copied []any
+	if err := gob.NewDecoder(&buf).Decode(&copied); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if digest(orig) != digest(copied[0]) {
+		t.Fatalf("%+v and its gob copy %+v have different digests", orig, copied[0])
+	}
+	rebuilt := command{"k", &inner{7}, map[string]int{"c": 3, "b": 2, "a": 1}, []any{1, "x"}}
+	if digest(orig) != digest(rebuilt) {
+		t.Fatalf("equal commands have different digests")
+	}
+	for _, other := range []command{
+		{"k", &inner{8}, orig.Tags, orig.Items},
+		{"k", orig.Ptr, map[string]int{"a": 1, "b": 2}, orig.Items},
+		{"k", orig.Ptr, orig.Tags, []any{"1", "x"}},
+	} {
+		if digest(orig) == digest(other) {
+			t.Fatalf("%+v and %+v have the same digest", orig, other)
+		}
+	}
+}
+
+// A leader that sends one follower different entries than the other is
+// caught by the followers comparing digests on their heartbeats, and they
+// stop acknowledging its ballot and elect another.
+func TestEquivocation4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+	// the servers are going to apply different commands
+	for i := range servers {
+		cfg.start1(i, cfg.applierUnchecked)
+		cfg.connect(i)
+	}
+
+	cfg.begin("Test (4): [TestEquivocation4] followers detect a leader sending them different entries")
+
+	leader := cfg.checkOneLeader()
+	victim := (leader + 1) % servers
+	cfg.equivocate(leader, func(peer int, entries []any) []any {
+		if peer != victim {
+			return entries
+		}
+		forged := make([]any, len(entries))
+		for i, entry := range entries {
+			forged[i] = -entry.(int)
+		}
+		return forged
+	})
+
+	index, _, ok := cfg.paxos[leader].Proposal(100)
+	if !ok {
+		t.Fatalf("leader %v did not take the proposal", leader)
+	}
+	cfg.paxos[leader].mu.Lock()
+	ballot := cfg.paxos[leader].currentRnd
+	cfg.paxos[leader].mu.Unlock()
+
+	for i := range servers {
+		if i == leader {
+			continue
+		}
+		var found []Equivocation
+		for iters := 0; iters < 50 && len(found) == 0; iters++ {
+			time.Sleep(50 * time.Millisecond)
+			found = cfg.paxos[i].Equivocations()
+		}
+		if len(found) == 0 {
+			t.Fatalf("server %v did not detect the equivocation", i)
+		}
+		if e := found[0]; e.N != ballot || e.Index != index || e.Peer == leader || e.Peer == i {
+			t.Fatalf("server %v detected %+v, expected ballot %v, index %v and the other follower", i, e, ballot, index)
+		}
+	}
+	if found := cfg.paxos[leader].Equivocations(); len(found) > 0 {
+		t.Fatalf("leader %v detected %+v in its own Accepts", leader, found)
+	}
+
+	// nobody acknowledges the ballot any more, so the followers have BLE
+	// elect another, and that one decides again
+	cfg.equivocate(leader, nil)
+	next := -1
+	for iters := 0; iters < 100 && next < 0; iters++ {
+		time.Sleep(50 * time.Millisecond)
+		for i := range servers {
+			cfg.paxos[i].mu.Lock()
+			if cfg.paxos[i].role == LEADER && cfg.paxos[i].phase == ACCEPT && cfg.paxos[i].currentRnd.Compare(ballot) > 0 {
+				next = i
+			}
+			cfg.paxos[i].mu.Unlock()
+		}
+	}
+	if next < 0 {
+		t.Fatalf("no leader was elected after ballot %v was distrusted", ballot)
+	}
+	index, _, ok = cfg.paxos[next].Proposal(101)
+	if !ok {
+		t.Fatalf("new leader %v did not take the proposal", next)
+	}
+	for i := range servers {
+		decided := false
+		for iters := 0; iters < 50 && !decided; iters++ {
+			time.Sleep(50 * time.Millisecond)
+			cfg.paxos[i].mu.Lock()
+			decided = cfg.paxos[i].decidedIdx > index
+			cfg.paxos[i].mu.Unlock()
+		}
+		if !decided {
+			t.Fatalf("server %v did not decide index %v in the new ballot", i, index)
+		}
+	}
+
+	cfg.end()
+}
+
 // same as the prev test, but just too many commands
 // just to ensure that the service is stable
 // enough to handle an intense load
@@ -840,271 +1402,1958 @@ loop:
 	cfg.end()
 }
 
-// submit a command (101)
-// then disconnect the leader (L1)
-// submit 3 commands (102, 103, 104) to the same leader (who won't be able to commit those)
-// submit a command to the new leader (L2) of the cluster (103)
-// disconnect new leader (L2)
-// connect old leader (L1) again
-// submit a command to it (L1) (104)
-// reconnect L2
-// everyone agrees to something
-// submit a final command (105)
-// Distributed Consensus Everyone!
-func TestRejoin4(t *testing.T) {
+// Under steady load every Accept carries the decisions made since the
+// previous one, so no separate Decide is sent: each command costs an
+// Accept and an Accepted per follower instead of three messages.
+func TestDecidePiggyback4(t *testing.T) {
 	servers := 3
-	cfg := makeConfig(t, servers, false, false)
+	paxosConfig := DefaultConfig()
+	paxosConfig.AcceptBatchSize = 1
+	cfg := makeConfigWith(t, servers, false, false, paxosConfig)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (4): [TestRejoin4] rejoin of partitioned leader")
+	cfg.begin("Test (4): [TestDecidePiggyback4] decisions ride on the next Accept")
 
-	cfg.one(101, servers, true)
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	rpcs0 := cfg.rpcTotal()
 
-	// Leader network failure.
-	leader1 := cfg.checkOneLeader()
-	cfg.disconnect(leader1)
+	iters := 200
+	last := -1
+	for i := 0; i < iters; i++ {
+		index, _, ok := cfg.paxos[leader].Proposal(rand.Int())
+		if !ok {
+			t.Fatalf("leader %v lost leadership", leader)
+		}
+		last = index
+		time.Sleep(acceptBatchWindow / 4)
+	}
+	cfg.wait(last, servers, -1)
 
-	// Make old leader try to agree on some entries.
-	cfg.paxos[leader1].Proposal(102)
-	cfg.paxos[leader1].Proposal(103)
-	cfg.paxos[leader1].Proposal(104)
+	// Accept + Accepted per follower, plus a few Decides and heartbeats
+	perCmd := float64(cfg.rpcTotal()-rpcs0) / float64(iters)
+	if limit := 2.5 * float64(servers-1); perCmd > limit {
+		t.Fatalf("%.2f RPCs per command; expected <= %.2f", perCmd, limit)
+	}
 
-	// New leader commits, also for index=2.
-	cfg.one(103, 2, true)
+	// decisions still reach the followers when nothing else is proposed
+	cfg.one(rand.Int(), servers, true)
 
-	// New leader network failure.
-	leader2 := cfg.checkOneLeader()
-	cfg.disconnect(leader2)
+	cfg.end()
+}
 
-	// Old leader connected again.
-	cfg.connect(leader1)
+// Sends to a follower that does not answer must not hold up replication
+// to the others, nor the leader's own proposals.
+func TestPartitionedFollower4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
 
-	// some sleep to make the system stable
-	time.Sleep(PaxosElectionTimeout)
+	cfg.begin("Test (4): [TestPartitionedFollower4] partitioned follower does not throttle the rest")
 
-	cfg.one(104, 2, true)
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
 
-	// All together now.
-	cfg.connect(leader2)
+	// every proposal goes out in its own Accept, and the partitioned
+	// follower is sent each of them
+	iters := 100
+	last := -1
+	start := time.Now()
+	for i := 0; i < iters; i++ {
+		index, _, ok := cfg.paxos[leader].Proposal(rand.Int())
+		if !ok {
+			t.Fatalf("leader %v lost leadership", leader)
+		}
+		last = index
+		time.Sleep(2 * acceptBatchWindow)
+	}
+	cfg.wait(last, servers-1, -1)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("%v proposals took %v to be decided with a follower partitioned", iters, elapsed)
+	}
 
-	cfg.one(105, servers, true)
+	cfg.connect((leader + 1) % servers)
+	cfg.one(rand.Int(), servers, true)
 
 	cfg.end()
 }
 
-func TestFig5aLogReplication4(t *testing.T) {
-	servers := 5
+// A follower that promised a ballot which then lost the election, and
+// whose Prepare from the elected leader was dropped, must not wait for a
+// sync from the loser: it asks the elected leader to resynchronize it.
+func TestLosingBallotFollower4(t *testing.T) {
+	servers := 3
 	cfg := makeConfig(t, servers, false, false)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (4): [TestFig5aLogReplication4] Partial Connectivity - Quorum-Loss Scenario (Fig 5a)")
-	// Get an initial leader
-	leader1 := cfg.checkOneLeader()
-	log.Warn().Msgf("Initial leader is %v", leader1)
+	cfg.begin("Test (4): [TestLosingBallotFollower4] follower promised to a ballot that lost the election")
 
-	// should be able to commit
-	cfg.one(101, servers, false)
-
-	// Now, we will mimic the scenario presented in Fig 5b
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	other := (leader + 2) % servers
+
+	// the follower promises a ballot of other's that is never elected,
+	// between the leader's and the one other is elected with
+	f := cfg.paxos[follower]
+	f.mu.Lock()
+	f.promisedRnd = BallotNumber{f.promisedRnd.Value, 1, other}
+	f.phase = PREPARE
+	f.persist()
+	f.mu.Unlock()
+
+	// other takes over with a higher ballot, and its Prepare to the
+	// follower is dropped
+	cfg.net.Enable(cfg.endnames[other][follower], false)
+	cfg.paxos[other].SetPriority(2)
+	for t0 := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		op := cfg.paxos[other]
+		op.mu.Lock()
+		leading := op.role == LEADER && op.phase == ACCEPT
+		op.mu.Unlock()
+		f.mu.Lock()
+		elected := f.L.Pid == other
+		f.mu.Unlock()
+		if leading && elected {
+			break
+		}
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("server %v never saw %v elected", follower, other)
+		}
+	}
+	cfg.net.Enable(cfg.endnames[other][follower], true)
+
+	cfg.one(rand.Int(), servers, true)
+	f.mu.Lock()
+	promised, phase := f.promisedRnd, f.phase
+	f.mu.Unlock()
+	if promised.Pid != other || phase != ACCEPT {
+		t.Fatalf("server %v promised %v in phase %v after %v was elected", follower, promised, phase, other)
+	}
+
+	cfg.end()
+}
+
+// Decided entries are applied as soon as the server learns about them,
+// not on the next polling tick.
+func TestApplyLatency4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestApplyLatency4] decided entries are applied without polling delay")
+
+	iters := 20
+	start := time.Now()
+	for i := 0; i < iters; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("%v agreements took %v", iters, elapsed)
+	}
+
+	for i := 0; i < servers; i++ {
+		stats := cfg.paxos[i].ApplyStats()
+		if stats.Entries < iters {
+			t.Fatalf("server %v counted %v applied entries, expected at least %v", i, stats.Entries, iters)
+		}
+		if stats.Mean > 10*time.Millisecond {
+			t.Fatalf("server %v applied entries %v after they were decided on average", i, stats.Mean)
+		}
+	}
+
+	cfg.end()
+}
+
+// dropAccepted loses every Accepted a follower sends
+type dropAccepted struct {
+	Transport
+}
+
+func (dropAccepted) Accepted(peer int, args *AcceptedFromFollowerRequest) bool {
+	return false
+}
+
+func TestReadIndex4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestReadIndex4] ReadIndex")
+
+	// on an empty log there is nothing to wait for, even where nothing
+	// is ever decided, here because the followers' Accepted are lost
+	network := NewLocalNetwork(servers)
+	for i := range servers {
+		op, err := MakeWithTransport(dropAccepted{network.Transport(i)}, i, MakePersister(), make(chan ApplyMsg), DefaultConfig())
+		if err != nil {
+			t.Fatalf("MakeWithTransport: %v", err)
+		}
+		defer op.Kill()
+		network.Register(i, op)
+	}
+	served := false
+	for t0 := time.Now(); !served && time.Since(t0) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		for i := range servers {
+			if readIdx, ok := network.servers[i].ReadIndex(); ok {
+				if readIdx != -1 {
+					t.Fatalf("ReadIndex on an empty log returned %v", readIdx)
+				}
+				served = true
+			}
+		}
+	}
+	if !served {
+		t.Fatalf("no leader served ReadIndex on an empty log")
+	}
+
+	index := cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+
+	// a read must observe every write that completed before it
+	readIdx, ok := cfg.paxos[leader].ReadIndex()
+	if !ok {
+		t.Fatalf("leader %v refused ReadIndex", leader)
+	}
+	if readIdx < index {
+		t.Fatalf("ReadIndex returned %v, before the decided write at %v", readIdx, index)
+	}
+	if nd, _ := cfg.nCommitted(readIdx); nd < 1 {
+		t.Fatalf("ReadIndex returned %v, which nobody has applied", readIdx)
+	}
+	for i := 0; i < servers; i++ {
+		if i == leader {
+			continue
+		}
+		if _, ok := cfg.paxos[i].ReadIndex(); ok {
+			t.Fatalf("follower %v served ReadIndex", i)
+		}
+	}
+
+	// a leader that has lost its majority must refuse to serve reads,
+	// even before it notices it is no longer the leader
+	cfg.disconnect(leader)
+	if _, ok := cfg.paxos[leader].ReadIndex(); ok {
+		t.Fatalf("leader %v served ReadIndex without a majority", leader)
+	}
+	index = cfg.one(rand.Int(), servers-1, true)
+	if _, ok := cfg.paxos[leader].ReadIndex(); ok {
+		t.Fatalf("old leader %v served ReadIndex after a new leader was elected", leader)
+	}
+
+	leader2 := cfg.checkOneLeader()
+	readIdx, ok = cfg.paxos[leader2].ReadIndex()
+	if !ok || readIdx < index {
+		t.Fatalf("new leader %v: ReadIndex returned %v, %v; expected at least %v", leader2, readIdx, ok, index)
+	}
+
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+// leaseReadCheck partitions the leader while reading from it with
+// LeaseRead, and checks that no read it serves starts after a new leader
+// has decided a write.
+func leaseReadCheck(t *testing.T, cfg *config, servers int) {
+	leader := cfg.checkOneLeader()
+	t0 := time.Now()
+	for _, ok := cfg.paxos[leader].LeaseRead(); !ok; _, ok = cfg.paxos[leader].LeaseRead() {
+		if time.Since(t0) > 2*time.Second {
+			t.Fatalf("leader %v never got a lease", leader)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < servers; i++ {
+		if _, ok := cfg.paxos[i].LeaseRead(); ok && i != leader {
+			t.Fatalf("follower %v served LeaseRead", i)
+		}
+	}
+
+	var mu sync.Mutex
+	var lastRead time.Time
+	served := 0
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			start := time.Now()
+			if _, ok := cfg.paxos[leader].LeaseRead(); ok {
+				mu.Lock()
+				lastRead = start
+				served++
+				mu.Unlock()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	cfg.disconnect(leader)
+	partitioned := time.Now()
+	mu.Lock()
+	served = 0
+	mu.Unlock()
+
+	// propose to the new leader, and note as soon as the write is decided
+	index := -1
+	for t0 = time.Now(); index == -1; {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("no new leader accepted a proposal")
+		}
+		for i := 0; i < servers && index == -1; i++ {
+			if i != leader {
+				index, _, _ = cfg.paxos[i].Proposal(rand.Int())
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for nd, _ := cfg.nCommitted(index); nd < 1; nd, _ = cfg.nCommitted(index) {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("the new leader's write at %v was not decided", index)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	decided := time.Now()
+
+	// keep reading until the old leader's lease has surely run out
+	time.Sleep(cfg.paxosConfig.LeaseDuration)
+	close(done)
+	<-stopped
+	mu.Lock()
+	defer mu.Unlock()
+	if served == 0 {
+		t.Fatalf("old leader %v served no reads after it was partitioned", leader)
+	}
+	if !lastRead.Before(decided) {
+		t.Fatalf("old leader %v served a read %v after a new leader decided a write", leader, lastRead.Sub(decided))
+	}
+	t.Logf("old leader served %v reads, the last %v before a write decided %v after the partition", served, decided.Sub(lastRead), decided.Sub(partitioned))
+
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers, true)
+}
+
+func TestLeaseRead4(t *testing.T) {
+	servers := 3
+	// long enough that the old leader's lease outlasts the election
+	paxosConfig := DefaultConfig()
+	paxosConfig.LeaseDuration = time.Second
+	cfg := makeConfigWith(t, servers, false, false, paxosConfig)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestLeaseRead4] LeaseRead")
+
+	cfg.one(rand.Int(), servers, true)
+	for iters := 0; iters < 3; iters++ {
+		leaseReadCheck(t, cfg, servers)
+	}
+
+	cfg.end()
+}
+
+// Leases must hold up with clocks that drift within maxClockDrift: here
+// the leader's clock runs slow and the followers' fast, so the leader
+// believes its lease lasts longest and the followers' grants run out
+// soonest. The leader's BLE rounds are also slow, so once partitioned it
+// goes on thinking it is the leader well after the others have elected
+// a new one.
+func TestLeaseReadSkewedClocks4(t *testing.T) {
+	servers := 3
+	paxosConfig := DefaultConfig()
+	paxosConfig.LeaseDuration = time.Second
+	cfg := makeConfigWith(t, servers, false, false, paxosConfig)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestLeaseReadSkewedClocks4] LeaseRead with skewed clocks")
+
+	cfg.one(rand.Int(), servers, true)
+	for iters := 0; iters < 3; iters++ {
+		leader := cfg.checkOneLeader()
+		for i := 0; i < servers; i++ {
+			if i == leader {
+				cfg.skewClock(i, 1-maxClockDrift)
+				cfg.slowHeartbeats(i, 400*time.Millisecond)
+			} else {
+				cfg.skewClock(i, 1+maxClockDrift)
+				cfg.slowHeartbeats(i, 100*time.Millisecond)
+			}
+		}
+		leaseReadCheck(t, cfg, servers)
+	}
+
+	cfg.end()
+}
+
+// countApplied returns how many times server has applied cmd
+func countApplied(cfg *config, server int, cmd any) int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	n := 0
+	for _, e := range cfg.logs[server] {
+		if e == (logEntry{true, cmd}) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSessionExactlyOnce4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestSessionExactlyOnce4] client sessions apply a command once")
+
+	cmd1 := SessionCommand{ClientID: 1, Seq: 1, Command: rand.Int()}
+	cfg.one(cmd1, servers, true)
+
+	// a retry that reaches the log is decided, but not applied
+	leader := cfg.checkOneLeader()
+	dup, _, ok := cfg.paxos[leader].Proposal(cmd1)
+	if !ok {
+		t.Fatalf("leader %v rejected a proposal", leader)
+	}
+	cfg.one(rand.Int(), servers, true)
+	if nd, _ := cfg.nCommitted(dup); nd > 0 {
+		t.Fatalf("%v servers applied a duplicate of %v at %v", nd, cmd1, dup)
+	}
+
+	for i := 0; i < servers; i++ {
+		cfg.paxos[i].SetSessionResult(1, 1, "result1")
+		if result, ok := cfg.paxos[i].SessionResult(1, 1); !ok || result != "result1" {
+			t.Fatalf("server %v: SessionResult(1, 1) = %v, %v", i, result, ok)
+		}
+		if _, ok := cfg.paxos[i].SessionResult(1, 2); ok {
+			t.Fatalf("server %v: SessionResult(1, 2) reports a command nobody proposed", i)
+		}
+	}
+
+	// the client retries with another leader after the first one fails,
+	// whether or not its proposal was decided
+	cmd2 := SessionCommand{ClientID: 1, Seq: 2, Command: rand.Int()}
+	cfg.paxos[leader].Proposal(cmd2)
+	cfg.disconnect(leader)
+	cfg.one(cmd2, servers-1, true)
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers, true)
+	for i := 0; i < servers; i++ {
+		if n := countApplied(cfg, i, cmd2); n != 1 {
+			t.Fatalf("server %v applied %v %v times", i, cmd2, n)
+		}
+		if result, ok := cfg.paxos[i].SessionResult(1, 1); !ok || result != nil {
+			t.Fatalf("server %v: SessionResult(1, 1) = %v, %v after the next command", i, result, ok)
+		}
+	}
+
+	cfg.end()
+}
+
+// awaitResult waits for a ProposeAsync result
+func awaitResult(t *testing.T, ch <-chan ProposalResult, timeout time.Duration) ProposalResult {
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(timeout):
+		t.Fatalf("no proposal result after %v", timeout)
+	}
+	return ProposalResult{}
+}
+
+func TestProposeAsync4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestProposeAsync4] ProposeAsync results")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+
+	cmd := rand.Int()
+	res := awaitResult(t, cfg.paxos[leader].ProposeAsync(cmd), 2*time.Second)
+	if res.Err != nil {
+		t.Fatalf("proposal to leader %v failed: %v", leader, res.Err)
+	}
+	if _, e := cfg.wait(res.Index, servers, -1); e != (logEntry{true, cmd}) {
+		t.Fatalf("ProposeAsync reported index %v, which holds %v", res.Index, e.command)
+	}
+
+	follower := (leader + 1) % servers
+	res = awaitResult(t, cfg.paxos[follower].ProposeAsync(rand.Int()), time.Second)
+	if !errors.Is(res.Err, ErrNotLeader) {
+		t.Fatalf("proposal to follower %v: got %v, expected %v", follower, res.Err, ErrNotLeader)
+	}
+
+	// a partitioned leader's entry is replaced once it rejoins
+	cfg.disconnect(leader)
+	lost := rand.Int()
+	ch := cfg.paxos[leader].ProposeAsync(lost)
+	cfg.one(rand.Int(), servers-1, true)
+	cfg.connect(leader)
+	res = awaitResult(t, ch, 5*time.Second)
+	if !errors.Is(res.Err, ErrOverwritten) && !errors.Is(res.Err, ErrLeaderChanged) {
+		t.Fatalf("proposal to deposed leader %v: got %v", leader, res.Err)
+	}
+	cfg.one(rand.Int(), servers, true)
+	for i := 0; i < servers; i++ {
+		if n := countApplied(cfg, i, lost); n != 0 {
+			t.Fatalf("server %v applied a command its proposer was told was lost", i)
+		}
+	}
+
+	// killing the leader fails what it has not decided
+	leader = cfg.checkOneLeader()
+	cfg.disconnect(leader)
+	ch = cfg.paxos[leader].ProposeAsync(rand.Int())
+	cfg.crash1(leader)
+	res = awaitResult(t, ch, time.Second)
+	if !errors.Is(res.Err, ErrKilled) {
+		t.Fatalf("proposal to killed leader %v: got %v, expected %v", leader, res.Err, ErrKilled)
+	}
+	cfg.start1(leader, cfg.applier)
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+// A future only reports success if the entry decided at its index is its
+// command, even if the entry was replaced without failing the future.
+func TestProposeAsyncOverwritten4(t *testing.T) {
+	servers := 3
+	network := NewLocalNetwork(servers)
+	paxos := make([]*OmniPaxos, servers)
+	for i := range servers {
+		op, err := MakeWithTransport(network.Transport(i), i, MakePersister(), make(chan ApplyMsg, 100), DefaultConfig())
+		if err != nil {
+			t.Fatalf("MakeWithTransport: %v", err)
+		}
+		defer op.Kill()
+		paxos[i] = op
+		network.Register(i, op)
+	}
+
+	leader := -1
+	for t0 := time.Now(); leader < 0 && time.Since(t0) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		for i := range servers {
+			if res := awaitResult(t, paxos[i].ProposeAsync(rand.Int()), 2*time.Second); res.Err == nil {
+				leader = i
+			}
+		}
+	}
+	if leader < 0 {
+		t.Fatalf("no proposal was decided")
+	}
+
+	// keep the next entry from being decided, then replace it
+	for i := range servers {
+		network.Connect(i, i == leader)
+	}
+	ch := paxos[leader].ProposeAsync(1000)
+	op := paxos[leader]
+	op.mu.Lock()
+	index := op.logLen() - 1
+	op.log[index-op.compactedIdx] = 2000
+	op.setDecided(index + 1)
+	op.mu.Unlock()
+
+	res := awaitResult(t, ch, time.Second)
+	if res.Index != index || !errors.Is(res.Err, ErrOverwritten) {
+		t.Fatalf("proposal whose entry was replaced: got %+v, expected index %v and %v", res, index, ErrOverwritten)
+	}
+}
+
+func TestForwardProposal4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestForwardProposal4] followers forward proposals to the leader")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	f1 := (leader + 1) % servers
+	f2 := (leader + 2) % servers
+
+	if _, _, ok := cfg.paxos[f1].Proposal(rand.Int()); ok {
+		t.Fatalf("follower %v accepted a proposal without forwarding", f1)
+	}
+
+	for i := 0; i < servers; i++ {
+		cfg.paxos[i].SetForwarding(true)
+	}
+	cmd := rand.Int()
+	index, _, ok := cfg.paxos[f1].Proposal(cmd)
+	if !ok {
+		t.Fatalf("follower %v did not forward a proposal", f1)
+	}
+	if _, e := cfg.wait(index, servers, -1); e != (logEntry{true, cmd}) {
+		t.Fatalf("forwarded proposal reported index %v, which holds %v", index, e.command)
+	}
+
+	// two followers that each believe the other leads must not bounce
+	// a proposal between them
+	cfg.paxos[f1].mu.Lock()
+	cfg.paxos[f2].mu.Lock()
+	l1, l2 := cfg.paxos[f1].L, cfg.paxos[f2].L
+	cfg.paxos[f1].L.Pid, cfg.paxos[f2].L.Pid = f2, f1
+	cfg.paxos[f2].mu.Unlock()
+	cfg.paxos[f1].mu.Unlock()
+	lost := rand.Int()
+	_, _, ok = cfg.paxos[f1].Proposal(lost)
+	cfg.paxos[f1].mu.Lock()
+	cfg.paxos[f2].mu.Lock()
+	cfg.paxos[f1].L, cfg.paxos[f2].L = l1, l2
+	cfg.paxos[f2].mu.Unlock()
+	cfg.paxos[f1].mu.Unlock()
+	if ok {
+		t.Fatalf("a proposal forwarded to a follower was accepted")
+	}
+
+	cfg.one(rand.Int(), servers, true)
+	for i := 0; i < servers; i++ {
+		if n := countApplied(cfg, i, lost); n != 0 {
+			t.Fatalf("server %v applied a proposal that was reported lost", i)
+		}
+	}
+
+	cfg.end()
+}
+
+// A proposal made while the leader prepares its round is buffered, and
+// reports the index it ends up at once the round starts.
+func TestBufferedProposal4(t *testing.T) {
+	servers := 3
+	paxosConfig := DefaultConfig()
+	paxosConfig.BufferedProposalTimeout = 100 * time.Millisecond
+	cfg := makeConfigWith(t, servers, false, false, paxosConfig)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestBufferedProposal4] proposals buffered during PREPARE")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	next := (leader + 1) % servers
+
+	// next elects itself, but the other follower keeps granting the old
+	// leader leases and won't promise until they run out
+	cfg.partiallyDisconnect(next, []int{leader})
+	preparing := false
+	for iters := 0; iters < 50 && !preparing; iters++ {
+		time.Sleep(100 * time.Millisecond)
+		op := cfg.paxos[next]
+		op.mu.Lock()
+		preparing = op.role == LEADER && op.phase == PREPARE
+		op.mu.Unlock()
+	}
+	if !preparing {
+		t.Fatalf("server %v never started preparing a round", next)
+	}
+
+	// a proposal that waits too long is withdrawn
+	withdrawn := rand.Int()
+	if _, _, ok := cfg.paxos[next].Proposal(withdrawn); ok {
+		t.Fatalf("Proposal succeeded while server %v was still preparing", next)
+	}
+
+	cfg.paxos[next].mu.Lock()
+	cfg.paxos[next].config.BufferedProposalTimeout = 5 * time.Second
+	cfg.paxos[next].mu.Unlock()
+	type result struct {
+		index int
+		ok    bool
+	}
+	cmd1, cmd2 := rand.Int(), rand.Int()
+	results := make(chan result)
+	go func() {
+		index, _, ok := cfg.paxos[next].Proposal(cmd1)
+		results <- result{index, ok}
+	}()
+	ch := cfg.paxos[next].ProposeAsync(cmd2)
+
+	cfg.disconnect(leader)
+	res1 := <-results
+	if !res1.ok {
+		t.Fatalf("buffered Proposal failed")
+	}
+	res2 := awaitResult(t, ch, 5*time.Second)
+	if res2.Err != nil {
+		t.Fatalf("buffered ProposeAsync failed: %v", res2.Err)
+	}
+	if _, e := cfg.wait(res1.index, servers-1, -1); e != (logEntry{true, cmd1}) {
+		t.Fatalf("buffered Proposal reported index %v, which holds %v", res1.index, e.command)
+	}
+	if _, e := cfg.wait(res2.Index, servers-1, -1); e != (logEntry{true, cmd2}) {
+		t.Fatalf("buffered ProposeAsync reported index %v, which holds %v", res2.Index, e.command)
+	}
+
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers, true)
+	for i := 0; i < servers; i++ {
+		if n := countApplied(cfg, i, cmd1); n != 1 {
+			t.Fatalf("server %v applied a buffered command %v times", i, n)
+		}
+		if n := countApplied(cfg, i, withdrawn); n != 0 {
+			t.Fatalf("server %v applied a withdrawn command", i)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestTransferLeadership4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestTransferLeadership4] leadership transfer")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	target := (leader + 1) % servers
+
+	if cfg.paxos[target].TransferLeadership(leader) {
+		t.Fatalf("follower %v transferred leadership", target)
+	}
+
+	// entries proposed just before the transfer are not lost
+	cmds := map[int]int{}
+	for i := 0; i < 20; i++ {
+		cmd := rand.Int()
+		index, _, ok := cfg.paxos[leader].Proposal(cmd)
+		if !ok {
+			t.Fatalf("leader %v rejected a proposal", leader)
+		}
+		cmds[index] = cmd
+	}
+	t0 := time.Now()
+	if !cfg.paxos[leader].TransferLeadership(target) {
+		t.Fatalf("leader %v failed to transfer leadership to %v", leader, target)
+	}
+	if elapsed := time.Since(t0); elapsed > time.Second {
+		t.Fatalf("transfer took %v", elapsed)
+	}
+	if _, ok := cfg.paxos[leader].GetState(); ok {
+		t.Fatalf("old leader %v did not step down", leader)
+	}
+	if l := cfg.checkOneLeader(); l != target {
+		t.Fatalf("leader is %v after transferring to %v", l, target)
+	}
+	for index, cmd := range cmds {
+		if _, e := cfg.wait(index, servers, -1); e != (logEntry{true, cmd}) {
+			t.Fatalf("index %v holds %v after the transfer, expected %v", index, e.command, cmd)
+		}
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	// a transfer to an unreachable server gives up, and the leader
+	// carries on
+	leader = target
+	target = (leader + 1) % servers
+	cfg.disconnect(target)
+	if cfg.paxos[leader].TransferLeadership(target) {
+		t.Fatalf("leader %v transferred leadership to disconnected %v", leader, target)
+	}
+	if l := cfg.checkOneLeader(); l != leader {
+		t.Fatalf("leader changed from %v to %v after a failed transfer", leader, l)
+	}
+	cfg.one(rand.Int(), servers-1, true)
+	cfg.connect(target)
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+// submit a command (101)
+// then disconnect the leader (L1)
+// submit 3 commands (102, 103, 104) to the same leader (who won't be able to commit those)
+// submit a command to the new leader (L2) of the cluster (103)
+// disconnect new leader (L2)
+// connect old leader (L1) again
+// submit a command to it (L1) (104)
+// reconnect L2
+// everyone agrees to something
+// submit a final command (105)
+// Distributed Consensus Everyone!
+func TestRejoin4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestRejoin4] rejoin of partitioned leader")
+
+	cfg.one(101, servers, true)
+
+	// Leader network failure.
+	leader1 := cfg.checkOneLeader()
+	cfg.disconnect(leader1)
+
+	// Make old leader try to agree on some entries.
+	cfg.paxos[leader1].Proposal(102)
+	cfg.paxos[leader1].Proposal(103)
+	cfg.paxos[leader1].Proposal(104)
+
+	// New leader commits, also for index=2.
+	cfg.one(103, 2, true)
+
+	// New leader network failure.
+	leader2 := cfg.checkOneLeader()
+	cfg.disconnect(leader2)
+
+	// Old leader connected again.
+	cfg.connect(leader1)
+
+	// some sleep to make the system stable
+	time.Sleep(PaxosElectionTimeout)
+
+	cfg.one(104, 2, true)
+
+	// All together now.
+	cfg.connect(leader2)
+
+	cfg.one(105, servers, true)
+
+	cfg.end()
+}
+
+// A server that has never decided anything is elected before it hears
+// from the old leader; the promises must still give it the decided log.
+func TestFreshLeader4(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestFreshLeader4] leader elected with an empty log")
+
+	leader := cfg.checkOneLeader()
+	fresh := (leader + 1) % servers
+	cfg.crash1(fresh)
+	for i := 0; i < 5; i++ {
+		cfg.one(rand.Int(), servers-1, true)
+	}
+
+	// it comes back with an empty disk, like a server that was down from
+	// the start: it has never promised, accepted or decided anything
+	cfg.mu.Lock()
+	cfg.saved[fresh] = nil
+	cfg.mu.Unlock()
+	cfg.start1(fresh, cfg.applier)
+
+	// connected to everyone but the leader, so it is never synchronized
+	// before it takes over
+	var others []int
+	for i := 0; i < servers; i++ {
+		if i != leader && i != fresh {
+			others = append(others, i)
+		}
+	}
+	cfg.paxos[fresh].SetPriority(1)
+	cfg.partiallyConnect(fresh, others)
+	time.Sleep(2 * PaxosElectionTimeout)
+	// the old leader does not hear of it, and may still think it leads
+	if _, isLeader := cfg.paxos[fresh].GetState(); !isLeader {
+		t.Fatalf("preferred server %v did not take over from %v", fresh, leader)
+	}
+	cfg.one(rand.Int(), servers-1, true)
+
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+// nil marks a hole in the log, so it cannot be proposed
+func TestNilProposal4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestNilProposal4] nil proposals are refused")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	if index, _, ok := cfg.paxos[leader].Proposal(nil); ok || index != -1 {
+		t.Fatalf("leader %v accepted a nil proposal at %v", leader, index)
+	}
+	if res := <-cfg.paxos[leader].ProposeAsync(nil); res.Err != ErrNilCommand {
+		t.Fatalf("ProposeAsync(nil) returned %+v, expected %v", res, ErrNilCommand)
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestFig5aLogReplication4(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestFig5aLogReplication4] Partial Connectivity - Quorum-Loss Scenario (Fig 5a)")
+	// Get an initial leader
+	leader1 := cfg.checkOneLeader()
+	log.Warn().Msgf("Initial leader is %v", leader1)
+
+	// should be able to commit
+	cfg.one(101, servers, false)
+
+	// Now, we will mimic the scenario presented in Fig 5b
+	// of the OmniPaxos paper
+
+	// Let S != leader1, be a server in our clutser
+	// S will be connected to everyone
+	// every other server would ONLY be connected to S
+
+	for i := 0; i < servers; i++ {
+		// disconnect everyone
+		cfg.disconnect(i)
+	}
+
+	// define S - any random server other than leader1
+	S := rand.Int() % servers
+	for ; S == leader1; S = rand.Int() % servers {
+	}
+	log.Warn().Msgf("S is %v", S)
+
+	// connect S to everyone
+	var serversToConnectTo []int
+	for i := 0; i < servers; i++ {
+		// if i != S {
+		serversToConnectTo = append(serversToConnectTo, i)
+		// }
+	}
+	cfg.partiallyConnect(S, serversToConnectTo)
+
+	log.Warn().Msgf("Partial Connectivity Established. Server with QC is %v", S)
+
+	// wait for some time so that the system can reach a steady state
+	time.Sleep(2 * PaxosElectionTimeout)
+
+	// should have a new leader since leader1
+	// has lost quorum connectivity
+	leader2 := cfg.checkOneLeader()
+	log.Warn().Msgf("New leader is %v", leader2)
+
+	if leader2 != S {
+		t.Fatalf("Server %v is the only server with QC, yet got %v as a leader", S, leader2)
+	}
+
+	// should also commit
+	cfg.paxos[leader2].Proposal(102)
+	cfg.paxos[leader2].Proposal(103)
+	cfg.paxos[leader2].Proposal(104)
+
+	// restore original state
+	// where everyone is connected
+
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+
+	// wait for some time so that the system can reach a steady state
+	time.Sleep(PaxosElectionTimeout)
+
+	cfg.one(105, servers, false)
+	cfg.one(106, servers, false)
+	cfg.end()
+}
+
+func TestFig5bLogReplication4(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestFig5bLogReplication4] Partial Connectivity - Constrained Election Scenario (Fig 5b)")
+	// Get an initial leader
+
+	// should be able to commit
+	cfg.one(101, servers, false)
+
+	leader1 := cfg.checkOneLeader()
+	log.Warn().Msgf("Initial leader is %v", leader1)
+
+	// Now, we will mimic the scenario presented in Fig 5a
+	// of the OmniPaxos paper
+
+	// Let S != leader1, be a server in our clutser
+	// S will be connected to everyone but leader1
+	// every other server (except leader1) would ONLY be connected to S
+
+	for i := 0; i < servers; i++ {
+		// disconnect everyone
+		cfg.disconnect(i)
+	}
+
+	// define S
+	S := rand.Int() % servers
+	for ; S == leader1; S = rand.Int() % servers {
+	}
+	log.Warn().Msgf("S is %v", S)
+
+	// connect S to everyone (but leader1)
+	var serversToConnectTo []int
+	for i := 0; i < servers; i++ {
+		if i != leader1 {
+			serversToConnectTo = append(serversToConnectTo, i)
+		}
+	}
+	cfg.partiallyConnect(S, serversToConnectTo)
+
+	log.Warn().Msgf("Partial Connectivity Established. Server with QC is %v", S)
+
+	// wait for some time so that the system can reach a steady state
+	time.Sleep(2 * PaxosElectionTimeout)
+
+	// should have a new leader since leader1
+	// has lost quorum connectivity
+	leader2 := cfg.checkOneLeader()
+	log.Warn().Msgf("New leader is %v", leader2)
+	if leader2 != S {
+		t.Fatalf("Server %v is the only server with QC, yet got %v as a leader", S, leader2)
+	}
+
+	// should also commit
+	// but only by (server-1) servers, since
+	// leader1 is not connected to anyone
+	cfg.paxos[leader2].Proposal(102)
+	cfg.paxos[leader2].Proposal(103)
+	cfg.paxos[leader2].Proposal(104)
+
+	// restore original state
+	// where everyone is connected
+
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+
+	// wait for some time so that the system can reach a steady state
+	time.Sleep(PaxosElectionTimeout)
+
+	cfg.one(105, servers, false)
+	cfg.one(106, servers, false)
+
+	cfg.end()
+}
+
+func TestFig5cLogReplication4(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4): [TestFig5cLogReplication4] Partial Connectivity - Chained Scenario (Fig 5c)")
+	// Get an initial leader
+	leader1 := cfg.checkOneLeader()
+	log.Warn().Msgf("Initial leader is %v", leader1)
+	cfg.one(101, servers, false)
+
+	// Now, we will mimic the scenario presented in Fig 5c
 	// of the OmniPaxos paper
 
-	// Let S != leader1, be a server in our clutser
-	// S will be connected to everyone
-	// every other server would ONLY be connected to S
+	// Let S != leader1, be a server in our clutser
+	// S and leader1 will be disconnected from each other
+
+	// define S
+	S := rand.Int() % servers
+	for ; S == leader1; S = rand.Int() % servers {
+	}
+	log.Warn().Msgf("S is %v", S)
+
+	// connect S to everyone (but leader1)
+	cfg.partiallyDisconnect(S, []int{leader1})
+
+	log.Warn().Msgf("Partial Connectivity Established. Server with QC is %v", S)
+
+	// wait for some time so that the system can reach a steady state
+	time.Sleep(2 * PaxosElectionTimeout)
+
+	// should have a new leader since leader1
+	// has can't commnunicate with S
+	// so S will timeout waiting for leader1's Heartbeat
+	// and then increase it's ballot
+	leader2 := cfg.checkOneLeader()
+	log.Warn().Msgf("New leader is %v", leader2)
+	if leader2 != S {
+		t.Fatalf("Server %v is the only server with QC, yet got %v as a leader", S, leader2)
+	}
+
+	// should also commit
+	// but only by (server-1) servers
+	// since leader1 is not connected to
+	// leader2 (see Fig5 C)
+	cfg.paxos[leader2].Proposal(102)
+	cfg.paxos[leader2].Proposal(103)
+	cfg.paxos[leader2].Proposal(104)
+
+	// restore original state
+	// where everyone is connected
+
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+
+	// wait for some time so that the system can reach a steady state
+	time.Sleep(PaxosElectionTimeout)
+
+	cfg.one(105, servers, false)
+	cfg.one(106, servers, false)
+
+	cfg.end()
+
+}
+
+// commit a command
+// crash and restart every server
+// commit another command
+// crash and restart leaders one at a time
+// (they should recover their logs and promises from the persister)
+func TestPersistBasic5(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (5): [TestPersistBasic5] basic persistence")
+
+	cfg.one(11, servers, true)
+
+	// crash and re-start all.
+	for i := 0; i < servers; i++ {
+		cfg.start1(i, cfg.applier)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+
+	cfg.one(12, servers, true)
+
+	leader1 := cfg.checkOneLeader()
+	cfg.start1(leader1, cfg.applier)
+	cfg.connect(leader1)
+
+	cfg.one(13, servers, true)
+
+	leader2 := cfg.checkOneLeader()
+	cfg.crash1(leader2)
+
+	cfg.one(14, servers-1, true)
+
+	cfg.start1(leader2, cfg.applier)
+	cfg.connect(leader2)
+
+	// wait for leader2 to catch up.
+	cfg.wait(3, servers, -1)
+
+	i3 := (cfg.checkOneLeader() + 1) % servers
+	cfg.crash1(i3)
+
+	cfg.one(15, servers-1, true)
+
+	cfg.start1(i3, cfg.applier)
+	cfg.connect(i3)
+
+	cfg.one(16, servers, true)
+
+	cfg.end()
+}
+
+// crash followers and leaders while proposals are still being
+// replicated, then restart them and check that everyone converges
+// on the same log
+func TestPersistMidReplication5(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (5): [TestPersistMidReplication5] crash and restart during replication")
+
+	cfg.one(rand.Int(), servers, true)
+
+	for iters := 0; iters < 4; iters++ {
+		leader := cfg.checkOneLeader()
+
+		// the leader is crashed every other iteration.
+		victim := (leader + 1 + iters) % servers
+		if iters%2 == 1 {
+			victim = leader
+		}
+
+		// leave a batch of entries in flight.
+		for i := 0; i < 10; i++ {
+			cfg.paxos[leader].Proposal(rand.Int())
+		}
+		cfg.crash1(victim)
+
+		cfg.one(rand.Int(), servers-1, true)
+
+		cfg.start1(victim, cfg.applier)
+		cfg.connect(victim)
+
+		cfg.one(rand.Int(), servers, true)
+	}
+
+	// crash everyone with entries in flight.
+	leader := cfg.checkOneLeader()
+	for i := 0; i < 10; i++ {
+		cfg.paxos[leader].Proposal(rand.Int())
+	}
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i, cfg.applier)
+		cfg.connect(i)
+	}
+
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+const MAXLOGSIZE = 2000
+
+// snapcommon commits entries while a victim server is cut off, long
+// enough that everyone else compacts the entries it is missing, so it
+// has to be brought up to date from a snapshot.
+func snapcommon(t *testing.T, name string, disconnect bool, reliable bool, crash bool) {
+	iters := 10
+	servers := 3
+	cfg := makeConfig(t, servers, !reliable, true)
+	defer cfg.cleanup()
+
+	cfg.begin(name)
+
+	cfg.one(rand.Int(), servers, true)
+	leader1 := cfg.checkOneLeader()
+
+	for i := 0; i < iters; i++ {
+		victim := (leader1 + 1) % servers
+		sender := leader1
+		if i%3 == 1 {
+			sender = (leader1 + 1) % servers
+			victim = leader1
+		}
+
+		if disconnect {
+			cfg.disconnect(victim)
+			cfg.one(rand.Int(), servers-1, true)
+		}
+		if crash {
+			cfg.crash1(victim)
+			cfg.one(rand.Int(), servers-1, true)
+		}
+
+		// perhaps send enough to get a snapshot
+		nn := (SnapShotInterval / 2) + (rand.Int() % SnapShotInterval)
+		for i := 0; i < nn; i++ {
+			cfg.paxos[sender].Proposal(rand.Int())
+		}
+
+		// let applier threads catch up with the Proposal()'s
+		if disconnect == false && crash == false {
+			// make sure all followers have caught up, so that
+			// an InstallSnapshot RPC isn't required for
+			// TestSnapshotBasic6().
+			cfg.one(rand.Int(), servers, true)
+		} else {
+			cfg.one(rand.Int(), servers-1, true)
+		}
+
+		if cfg.LogSize() >= MAXLOGSIZE {
+			t.Fatalf("Log size too large")
+		}
+		if disconnect {
+			// reconnect a follower, who maybe behind and
+			// needs to receive a snapshot to catch up.
+			cfg.connect(victim)
+			cfg.one(rand.Int(), servers, true)
+			leader1 = cfg.checkOneLeader()
+		}
+		if crash {
+			cfg.start1(victim, cfg.applierSnap)
+			cfg.connect(victim)
+			cfg.one(rand.Int(), servers, true)
+			leader1 = cfg.checkOneLeader()
+		}
+	}
+	cfg.end()
+}
+
+func TestSnapshotBasic6(t *testing.T) {
+	snapcommon(t, "Test (6): [TestSnapshotBasic6] snapshots basic", false, true, false)
+}
+
+func TestSnapshotInstall6(t *testing.T) {
+	snapcommon(t, "Test (6): [TestSnapshotInstall6] install snapshots (disconnect)", true, true, false)
+}
+
+func TestSnapshotInstallCrash6(t *testing.T) {
+	snapcommon(t, "Test (6): [TestSnapshotInstallCrash6] install snapshots (crash)", false, true, true)
+}
+
+// crash and restart all servers after they have compacted their logs;
+// they must come back from their own snapshots
+func TestSnapshotAllCrash6(t *testing.T) {
+	servers := 3
+	iters := 5
+	cfg := makeConfig(t, servers, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (6): [TestSnapshotAllCrash6] crash and restart all servers")
+
+	cfg.one(rand.Int(), servers, true)
+
+	for i := 0; i < iters; i++ {
+		// perhaps enough to get a snapshot
+		nn := (SnapShotInterval / 2) + (rand.Int() % SnapShotInterval)
+		for i := 0; i < nn; i++ {
+			cfg.one(rand.Int(), servers, true)
+		}
+
+		index1 := cfg.one(rand.Int(), servers, true)
+
+		// crash all
+		for i := 0; i < servers; i++ {
+			cfg.crash1(i)
+		}
+
+		// revive all
+		for i := 0; i < servers; i++ {
+			cfg.start1(i, cfg.applierSnap)
+			cfg.connect(i)
+		}
+
+		index2 := cfg.one(rand.Int(), servers, true)
+		if index2 < index1+1 {
+			t.Fatalf("index decreased from %v to %v", index1, index2)
+		}
+	}
+	cfg.end()
+}
+
+// A recovering follower can get an AcceptSync the leader sent for an
+// earlier Prepare of the same round, after it has compacted past the
+// sync's start. It must neither misplace the suffix nor cut its log short.
+func TestStaleAcceptSync6(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (6): [TestStaleAcceptSync6] stale AcceptSync after compaction")
+
+	for i := 0; i < SnapShotInterval/2; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	op := cfg.paxos[leader]
+	op.mu.Lock()
+	stale := AcceptSyncFromLeaderRequest{Me: leader, N: op.currentRnd, Sfx: append([]any{}, op.log...),
+		Syncidx: op.compactedIdx, DecIdx: op.decidedIdx}
+	op.mu.Unlock()
+
+	for i := 0; i < 2*SnapShotInterval; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+	f := cfg.paxos[follower]
+	f.mu.Lock()
+	if f.compactedIdx <= stale.Syncidx || f.promisedRnd != stale.N {
+		f.mu.Unlock()
+		t.Fatalf("follower %v did not compact past %v in round %v", follower, stale.Syncidx, stale.N)
+	}
+	before := f.logLen()
+	f.phase = RECOVER
+	f.mu.Unlock()
+	f.AcceptSyncFromLeader(&stale, &DummyReply{})
+
+	op.mu.Lock()
+	f.mu.Lock()
+	after := f.logLen()
+	mismatch := -1
+	for i := max(op.compactedIdx, f.compactedIdx); i < min(op.logLen(), f.logLen()); i++ {
+		if f.log[i-f.compactedIdx] != op.log[i-op.compactedIdx] {
+			mismatch = i
+			break
+		}
+	}
+	f.mu.Unlock()
+	op.mu.Unlock()
+	if after < before {
+		t.Fatalf("follower %v cut its log from %v to %v entries", follower, before, after)
+	}
+	if mismatch >= 0 {
+		t.Fatalf("follower %v and leader %v hold different entries at %v", follower, leader, mismatch)
+	}
+
+	cfg.one(rand.Int(), servers, true)
+	cfg.end()
+}
+
+// An AcceptSync waits in the outbox while the leader goes on compacting.
+// The session table it carries must stay that of its snapshot, or the
+// follower takes the commands decided after it for duplicates.
+func TestSyncSnapshotSessions6(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (6): [TestSyncSnapshotSessions6] session table of a queued sync")
+
+	compact := func() {
+		for i := 0; i < 2*SnapShotInterval; i++ {
+			cfg.one(rand.Int(), servers, true)
+		}
+	}
+	cfg.one(SessionCommand{ClientID: 7, Seq: 1, Command: rand.Int()}, servers, true)
+	compact()
+	leader := cfg.checkOneLeader()
+	op := cfg.paxos[leader]
+	op.mu.Lock()
+	_, snapshotIdx, sessions := op.syncSnapshot(0)
+	op.mu.Unlock()
+	if snapshotIdx == 0 || sessions[7].Seq != 1 {
+		t.Fatalf("leader %v syncs from snapshot %v with session %+v", leader, snapshotIdx, sessions[7])
+	}
+
+	cfg.one(SessionCommand{ClientID: 7, Seq: 2, Command: rand.Int()}, servers, true)
+	compact()
+	op.mu.Lock()
+	seq := sessions[7].Seq
+	op.mu.Unlock()
+	if seq != 1 {
+		t.Fatalf("the session table of a sync from snapshot %v moved on to Seq %v", snapshotIdx, seq)
+	}
+
+	cfg.end()
+}
+
+// The session table must survive snapshots, restarts and catching up
+// from the leader's snapshot.
+func TestSessionSnapshot6(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (6): [TestSessionSnapshot6] client sessions with snapshots")
+
+	// the tester's snapshots hold the last int command, so mix some in
+	var seq int64
+	propose := func(n int, expectedServers int) SessionCommand {
+		var cmd SessionCommand
+		for i := 0; i < n; i++ {
+			seq++
+			cmd = SessionCommand{ClientID: 7, Seq: seq, Command: rand.Int()}
+			cfg.one(cmd, expectedServers, true)
+			cfg.one(rand.Int(), expectedServers, true)
+			cfg.one(rand.Int(), expectedServers, true)
+		}
+		return cmd
+	}
+	// decide enough entries that the log is compacted past cmd
+	compact := func(expectedServers int) {
+		for i := 0; i < 2*SnapShotInterval; i++ {
+			cfg.one(rand.Int(), expectedServers, true)
+		}
+	}
+	// checkDuplicate proposes cmd again and checks nobody applies it
+	checkDuplicate := func(cmd SessionCommand) {
+		leader := cfg.checkOneLeader()
+		dup, _, ok := cfg.paxos[leader].Proposal(cmd)
+		if !ok {
+			t.Fatalf("leader %v rejected a proposal", leader)
+		}
+		cfg.one(rand.Int(), servers, true)
+		if nd, _ := cfg.nCommitted(dup); nd > 0 {
+			t.Fatalf("%v servers applied a duplicate of %v at %v", nd, cmd, dup)
+		}
+	}
+	checkResult := func(i int, cmd SessionCommand, want any) {
+		if result, ok := cfg.paxos[i].SessionResult(cmd.ClientID, cmd.Seq); !ok || result != want {
+			t.Fatalf("server %v: SessionResult(%v, %v) = %v, %v; expected %v", i, cmd.ClientID, cmd.Seq, result, ok, want)
+		}
+	}
 
+	cmd := propose(10, servers)
 	for i := 0; i < servers; i++ {
-		// disconnect everyone
-		cfg.disconnect(i)
+		cfg.paxos[i].SetSessionResult(cmd.ClientID, cmd.Seq, "done")
 	}
+	compact(servers)
 
-	// define S - any random server other than leader1
-	S := rand.Int() % servers
-	for ; S == leader1; S = rand.Int() % servers {
+	// crash and restart all
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
 	}
-	log.Warn().Msgf("S is %v", S)
+	for i := 0; i < servers; i++ {
+		cfg.start1(i, cfg.applierSnap)
+		cfg.connect(i)
+	}
+	cfg.one(rand.Int(), servers, true)
+	for i := 0; i < servers; i++ {
+		checkResult(i, cmd, "done")
+	}
+	checkDuplicate(cmd)
 
-	// connect S to everyone
-	var serversToConnectTo []int
+	// a follower that falls behind installs the leader's snapshot
+	follower := (cfg.checkOneLeader() + 1) % servers
+	cfg.disconnect(follower)
+	cmd = propose(5, servers-1)
 	for i := 0; i < servers; i++ {
-		// if i != S {
-		serversToConnectTo = append(serversToConnectTo, i)
-		// }
+		if i != follower {
+			cfg.paxos[i].SetSessionResult(cmd.ClientID, cmd.Seq, "done again")
+		}
 	}
-	cfg.partiallyConnect(S, serversToConnectTo)
+	compact(servers - 1)
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers, true)
+	checkResult(follower, cmd, "done again")
+	checkDuplicate(cmd)
 
-	log.Warn().Msgf("Partial Connectivity Established. Server with QC is %v", S)
+	cfg.end()
+}
 
-	// wait for some time so that the system can reach a steady state
-	time.Sleep(2 * PaxosElectionTimeout)
+// catchupcommon disconnects a follower, moves leadership so the new
+// leader never sends it Accepts, and commits thousands of entries
+// without it. The follower must then be caught up in one AcceptSync
+// transfer: from the leader's snapshot if the service snapshots, or from
+// the log suffix streamed in chunks if it doesn't.
+func catchupcommon(t *testing.T, name string, snapshot bool, entries int) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, snapshot)
+	defer cfg.cleanup()
 
-	// should have a new leader since leader1
-	// has lost quorum connectivity
+	cfg.begin(name)
+
+	cfg.one(rand.Int(), servers, true)
+	leader1 := cfg.checkOneLeader()
+	victim := (leader1 + 1) % servers
+	cfg.disconnect(victim)
+	cfg.one(rand.Int(), servers-1, true)
+
+	// elect a leader that has never heard of the victim
+	cfg.disconnect(leader1)
+	cfg.one(rand.Int(), servers-2, true)
+	cfg.connect(leader1)
+	cfg.one(rand.Int(), servers-1, true)
 	leader2 := cfg.checkOneLeader()
-	log.Warn().Msgf("New leader is %v", leader2)
 
-	if leader2 != S {
-		t.Fatalf("Server %v is the only server with QC, yet got %v as a leader", S, leader2)
+	// a slow run may lose proposals to a leader change; keep proposing
+	// until the victim is far enough behind
+	for index := 0; index < entries; {
+		for i := index; i < entries; i++ {
+			if _, _, ok := cfg.paxos[leader2].Proposal(rand.Int()); !ok {
+				break
+			}
+		}
+		index = cfg.one(rand.Int(), servers-1, true)
+		leader2 = cfg.checkOneLeader()
 	}
 
-	// should also commit
-	cfg.paxos[leader2].Proposal(102)
-	cfg.paxos[leader2].Proposal(103)
-	cfg.paxos[leader2].Proposal(104)
+	var chunks atomic.Int32
+	cfg.net.RegisterCallback(func(svcMeth string, endname interface{}) {
+		if svcMeth == "OmniPaxos.SyncChunkFromLeader" {
+			chunks.Add(1)
+		}
+	})
+	cfg.connect(victim)
+	cfg.one(rand.Int(), servers, true)
 
-	// restore original state
-	// where everyone is connected
+	if snapshot {
+		if cfg.LogSize() >= MAXLOGSIZE {
+			t.Fatalf("Log size too large")
+		}
+		cfg.mu.Lock()
+		_, replayed := cfg.logs[victim][entries/2]
+		cfg.mu.Unlock()
+		if replayed {
+			t.Fatalf("server %v applied index %v from the log instead of installing a snapshot", victim, entries/2)
+		}
+	} else if chunks.Load() == 0 {
+		t.Fatalf("server %v caught up without the suffix being sent in chunks", victim)
+	}
 
-	for i := 0; i < servers; i++ {
-		cfg.connect(i)
+	cfg.end()
+}
+
+func TestCatchUpSnapshot6(t *testing.T) {
+	catchupcommon(t, "Test (6): [TestCatchUpSnapshot6] far-behind follower catches up from snapshot", true, 3000)
+}
+
+func TestCatchUpChunked6(t *testing.T) {
+	catchupcommon(t, "Test (6): [TestCatchUpChunked6] far-behind follower catches up from chunked suffix", false, 2000)
+}
+
+// waitStopSign waits for the StopSign at index to be decided by n
+// servers and checks that it is the one that was proposed
+func waitStopSign(t *testing.T, cfg *config, index int, n int, want StopSign) {
+	cfg.wait(index, n, -1)
+	cfg.mu.Lock()
+	ss, ok := cfg.stopSigns[index]
+	cfg.mu.Unlock()
+	if !ok || !reflect.DeepEqual(ss, want) {
+		t.Fatalf("expected StopSign %+v at index %v, got %+v", want, index, ss)
 	}
+}
 
-	// wait for some time so that the system can reach a steady state
-	time.Sleep(PaxosElectionTimeout)
+// checkStopped checks that no connected server accepts new commands
+func checkStopped(t *testing.T, cfg *config) {
+	for i := 0; i < cfg.n; i++ {
+		if !cfg.connected[i] {
+			continue
+		}
+		if index, _, ok := cfg.paxos[i].Proposal(rand.Int()); ok || index != -1 {
+			t.Fatalf("server %v accepted a proposal at %v after the StopSign", i, index)
+		}
+		if res := <-cfg.paxos[i].ProposeAsync(rand.Int()); res.Err != ErrStopped {
+			t.Fatalf("server %v returned %+v from ProposeAsync after the StopSign, expected %v", i, res, ErrStopped)
+		}
+		if index, _, ok := cfg.paxos[i].Reconfigure([]int{0}, nil); ok || index != -1 {
+			t.Fatalf("server %v accepted a second StopSign at %v", i, index)
+		}
+	}
+}
+
+func TestReconfigureStopSign7(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (7): [TestReconfigureStopSign7] StopSign is decided and stops the log")
+
+	for i := 0; i < 5; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+
+	leader := cfg.checkOneLeader()
+	want := StopSign{[]int{0, 1, 2, 3, 4}, []byte("next")}
+	index, _, ok := cfg.paxos[leader].Reconfigure(want.Peers, want.Metadata)
+	if !ok {
+		t.Fatalf("leader rejected Reconfigure")
+	}
+	waitStopSign(t, cfg, index, servers, want)
+	checkStopped(t, cfg)
+
+	// a crashed server still knows it is stopped after a restart
+	cfg.crash1(leader)
+	cfg.start1(leader, cfg.applier)
+	cfg.connect(leader)
+	waitStopSign(t, cfg, index, servers, want)
+	checkStopped(t, cfg)
 
-	cfg.one(105, servers, false)
-	cfg.one(106, servers, false)
 	cfg.end()
 }
 
-func TestFig5bLogReplication4(t *testing.T) {
+// the leader that proposed the StopSign fails before it is decided; the
+// remaining servers must agree on a single StopSign and stop
+func TestReconfigureLeaderFailure7(t *testing.T) {
 	servers := 5
 	cfg := makeConfig(t, servers, false, false)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (4): [TestFig5bLogReplication4] Partial Connectivity - Constrained Election Scenario (Fig 5b)")
-	// Get an initial leader
+	cfg.begin("Test (7): [TestReconfigureLeaderFailure7] StopSign proposed by a failing leader")
 
-	// should be able to commit
-	cfg.one(101, servers, false)
+	cfg.one(rand.Int(), servers, true)
 
 	leader1 := cfg.checkOneLeader()
-	log.Warn().Msgf("Initial leader is %v", leader1)
+	cfg.paxos[leader1].Reconfigure([]int{0, 1, 2}, []byte("first"))
+	cfg.disconnect(leader1)
 
-	// Now, we will mimic the scenario presented in Fig 5a
-	// of the OmniPaxos paper
+	// retry on the others until some StopSign is decided
+	want := StopSign{[]int{3, 4}, []byte("second")}
+	t0 := time.Now()
+	index := -1
+	for time.Since(t0).Seconds() < 10 && index == -1 {
+		for i := 0; i < servers; i++ {
+			if i != leader1 {
+				cfg.paxos[i].Reconfigure(want.Peers, want.Metadata)
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+		cfg.mu.Lock()
+		for idx := range cfg.stopSigns {
+			index = idx
+		}
+		cfg.mu.Unlock()
+	}
+	if index == -1 {
+		t.Fatalf("no StopSign was decided")
+	}
+	cfg.mu.Lock()
+	decided := cfg.stopSigns[index]
+	cfg.mu.Unlock()
+	waitStopSign(t, cfg, index, servers-1, decided)
+	checkStopped(t, cfg)
 
-	// Let S != leader1, be a server in our clutser
-	// S will be connected to everyone but leader1
-	// every other server (except leader1) would ONLY be connected to S
+	cfg.connect(leader1)
+	waitStopSign(t, cfg, index, servers, decided)
+	checkStopped(t, cfg)
 
-	for i := 0; i < servers; i++ {
-		// disconnect everyone
-		cfg.disconnect(i)
+	cfg.end()
+}
+
+// the servers of a new configuration start from the decided log of the
+// old one and continue after its StopSign
+func TestReconfigureNewConfig7(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (7): [TestReconfigureNewConfig7] new configuration continues the old log")
+
+	for i := 0; i < 10; i++ {
+		cfg.one(rand.Int(), servers, true)
 	}
+	leader := cfg.checkOneLeader()
+	want := StopSign{[]int{0, 1, 2, 3, 4}, nil}
+	index, _, _ := cfg.paxos[leader].Reconfigure(want.Peers, want.Metadata)
+	waitStopSign(t, cfg, index, servers, want)
 
-	// define S
-	S := rand.Int() % servers
-	for ; S == leader1; S = rand.Int() % servers {
+	state, snapshot, ok := cfg.paxos[(leader+1)%servers].NewConfigState()
+	if !ok {
+		t.Fatalf("no state for the next configuration after the StopSign was decided")
 	}
-	log.Warn().Msgf("S is %v", S)
 
-	// connect S to everyone (but leader1)
-	var serversToConnectTo []int
-	for i := 0; i < servers; i++ {
-		if i != leader1 {
-			serversToConnectTo = append(serversToConnectTo, i)
+	cfg2 := makeConfig(t, len(want.Peers), false, false)
+	defer cfg2.cleanup()
+	cfg2.restartFrom(state, snapshot, cfg2.applier)
+
+	// the tester may propose the command again if a leader buffered it
+	// while still preparing, so it can also appear later in the log
+	cmd := rand.Int()
+	cfg2.one(cmd, len(want.Peers), true)
+	cfg2.mu.Lock()
+	e := cfg2.logs[0][index+1]
+	cfg2.mu.Unlock()
+	if e != (logEntry{true, cmd}) {
+		t.Fatalf("new configuration committed %+v right after the StopSign, expected %v", e, cmd)
+	}
+	for i := 0; i <= index; i++ {
+		cfg.mu.Lock()
+		e1 := cfg.logs[0][i]
+		cfg.mu.Unlock()
+		cfg2.mu.Lock()
+		e2 := cfg2.logs[0][i]
+		cfg2.mu.Unlock()
+		if e1 != e2 {
+			t.Fatalf("new configuration has %+v at %v, old one had %+v", e2, i, e1)
 		}
 	}
-	cfg.partiallyConnect(S, serversToConnectTo)
+	for i := 0; i < 5; i++ {
+		cfg2.one(rand.Int(), len(want.Peers), true)
+	}
 
-	log.Warn().Msgf("Partial Connectivity Established. Server with QC is %v", S)
+	cfg.end()
+}
 
-	// wait for some time so that the system can reach a steady state
-	time.Sleep(2 * PaxosElectionTimeout)
+// cleaning test commands are "key=value" strings
+func keyOfTestCommand(command any) (string, bool) {
+	s, ok := command.(string)
+	if !ok {
+		return "", false
+	}
+	key, _, ok := strings.Cut(s, "=")
+	return key, ok
+}
 
-	// should have a new leader since leader1
-	// has lost quorum connectivity
-	leader2 := cfg.checkOneLeader()
-	log.Warn().Msgf("New leader is %v", leader2)
-	if leader2 != S {
-		t.Fatalf("Server %v is the only server with QC, yet got %v as a leader", S, leader2)
+// keyValueState is the state a key/value service on server would have
+// after applying everything the tester has seen it apply
+func keyValueState(cfg *config, server int) map[string]string {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	state := map[string]string{}
+	for i := 0; i < cfg.nextIndex[server]; i++ {
+		if s, ok := cfg.logs[server][i].command.(string); ok {
+			key, value, _ := strings.Cut(s, "=")
+			state[key] = value
+		}
 	}
+	return state
+}
 
-	// should also commit
-	// but only by (server-1) servers, since
-	// leader1 is not connected to anyone
-	cfg.paxos[leader2].Proposal(102)
-	cfg.paxos[leader2].Proposal(103)
-	cfg.paxos[leader2].Proposal(104)
+// checkCleaned checks that each server's decided log holds at most one
+// live entry per key
+func checkCleaned(t *testing.T, cfg *config, keys int) {
+	for i := 0; i < cfg.n; i++ {
+		if !cfg.connected[i] {
+			continue
+		}
+		op := cfg.paxos[i]
+		op.mu.Lock()
+		live := 0
+		for j := op.compactedIdx; j < op.decidedIdx; j++ {
+			if _, ok := op.log[j-op.compactedIdx].(string); ok {
+				live++
+			}
+		}
+		op.mu.Unlock()
+		if live > keys {
+			t.Fatalf("server %v has %v live entries for %v keys after cleaning", i, live, keys)
+		}
+	}
+}
 
-	// restore original state
-	// where everyone is connected
+func TestLogCleaning6(t *testing.T) {
+	servers := 3
+	keys := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (6): [TestLogCleaning6] key-based log cleaning")
+
+	cfg.enableLogCleaning(keyOfTestCommand)
+
+	want := map[string]string{}
+	put := func(n int, expectedServers int) {
+		for i := 0; i < n; i++ {
+			key := "k" + strconv.Itoa(rand.Int()%keys)
+			value := strconv.Itoa(rand.Int())
+			cfg.one(key+"="+value, expectedServers, true)
+			want[key] = value
+		}
+	}
 
+	put(60, servers)
+	// let a few cleaning rounds go by
+	time.Sleep(2 * time.Second)
+	checkCleaned(t, cfg, keys)
+	cfg.one(rand.Int(), servers, true) // has no key
 	for i := 0; i < servers; i++ {
-		cfg.connect(i)
+		if got := keyValueState(cfg, i); !reflect.DeepEqual(got, want) {
+			t.Fatalf("server %v has state %v, expected %v", i, got, want)
+		}
 	}
 
-	// wait for some time so that the system can reach a steady state
-	time.Sleep(PaxosElectionTimeout)
+	// a restarted server replays the cleaned log
+	follower := (cfg.checkOneLeader() + 1) % servers
+	cfg.crash1(follower)
+	put(20, servers-1)
+	cfg.start1(follower, cfg.applier)
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers, true)
+	if got := keyValueState(cfg, follower); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restarted server %v has state %v, expected %v", follower, got, want)
+	}
 
-	cfg.one(105, servers, false)
-	cfg.one(106, servers, false)
+	// a lagging server catches up from the cleaned log
+	follower = (cfg.checkOneLeader() + 1) % servers
+	cfg.disconnect(follower)
+	put(40, servers-1)
+	time.Sleep(2 * time.Second)
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers, true)
+	if got := keyValueState(cfg, follower); !reflect.DeepEqual(got, want) {
+		t.Fatalf("lagging server %v has state %v, expected %v", follower, got, want)
+	}
+	time.Sleep(2 * time.Second)
+	checkCleaned(t, cfg, keys)
 
 	cfg.end()
 }
 
-func TestFig5cLogReplication4(t *testing.T) {
+// A follower that was away while the others cleaned the entries it
+// missed catches up across the cleaned range, and ends up with the latest
+// value of every key.
+func TestLogCleaningCatchUp6(t *testing.T) {
 	servers := 3
+	keys := 2
 	cfg := makeConfig(t, servers, false, false)
 	defer cfg.cleanup()
 
-	cfg.begin("Test (4): [TestFig5cLogReplication4] Partial Connectivity - Chained Scenario (Fig 5c)")
-	// Get an initial leader
-	leader1 := cfg.checkOneLeader()
-	log.Warn().Msgf("Initial leader is %v", leader1)
-	cfg.one(101, servers, false)
-
-	// Now, we will mimic the scenario presented in Fig 5c
-	// of the OmniPaxos paper
+	cfg.begin("Test (6): [TestLogCleaningCatchUp6] catching up across a cleaned range")
 
-	// Let S != leader1, be a server in our clutser
-	// S and leader1 will be disconnected from each other
+	cfg.enableLogCleaning(keyOfTestCommand)
 
-	// define S
-	S := rand.Int() % servers
-	for ; S == leader1; S = rand.Int() % servers {
+	want := map[string]string{}
+	put := func(n int, expectedServers int) {
+		for i := 0; i < n; i++ {
+			key := "k" + strconv.Itoa(rand.Int()%keys)
+			value := strconv.Itoa(rand.Int())
+			cfg.one(key+"="+value, expectedServers, true)
+			want[key] = value
+		}
 	}
-	log.Warn().Msgf("S is %v", S)
 
-	// connect S to everyone (but leader1)
-	cfg.partiallyDisconnect(S, []int{leader1})
-
-	log.Warn().Msgf("Partial Connectivity Established. Server with QC is %v", S)
-
-	// wait for some time so that the system can reach a steady state
-	time.Sleep(2 * PaxosElectionTimeout)
-
-	// should have a new leader since leader1
-	// has can't commnunicate with S
-	// so S will timeout waiting for leader1's Heartbeat
-	// and then increase it's ballot
-	leader2 := cfg.checkOneLeader()
-	log.Warn().Msgf("New leader is %v", leader2)
-	if leader2 != S {
-		t.Fatalf("Server %v is the only server with QC, yet got %v as a leader", S, leader2)
+	put(10, servers)
+	follower := (cfg.checkOneLeader() + 1) % servers
+	cfg.disconnect(follower)
+	f := cfg.paxos[follower]
+	f.mu.Lock()
+	from := f.logLen()
+	f.mu.Unlock()
+	put(40, servers-1)
+
+	// cleaned reports whether server i has cleaned entries the follower
+	// missed
+	cleaned := func(i int) bool {
+		op := cfg.paxos[i]
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		for j := max(from, op.compactedIdx); j < op.decidedIdx; j++ {
+			if isCleaned(op.log[j-op.compactedIdx]) {
+				return true
+			}
+		}
+		return false
+	}
+	for t0 := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		done := true
+		for i := 0; i < servers; i++ {
+			done = done && (i == follower || cleaned(i))
+		}
+		if done {
+			break
+		}
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("the log past %v was not cleaned", from)
+		}
 	}
 
-	// should also commit
-	// but only by (server-1) servers
-	// since leader1 is not connected to
-	// leader2 (see Fig5 C)
-	cfg.paxos[leader2].Proposal(102)
-	cfg.paxos[leader2].Proposal(103)
-	cfg.paxos[leader2].Proposal(104)
-
-	// restore original state
-	// where everyone is connected
-
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers, true)
+	if got := keyValueState(cfg, follower); !reflect.DeepEqual(got, want) {
+		t.Fatalf("server %v caught up to state %v, expected %v", follower, got, want)
+	}
 	for i := 0; i < servers; i++ {
-		cfg.connect(i)
+		if got := keyValueState(cfg, i); !reflect.DeepEqual(got, want) {
+			t.Fatalf("server %v has state %v, expected %v", i, got, want)
+		}
 	}
 
-	// wait for some time so that the system can reach a steady state
-	time.Sleep(PaxosElectionTimeout)
-
-	cfg.one(105, servers, false)
-	cfg.one(106, servers, false)
-
 	cfg.end()
+}
 
+// BenchmarkAcceptBatching measures RPCs per command when a client keeps
+// proposals in flight, without batching and with the default batch size.
+// Heartbeats are included, so the reduction shows up as batches fill.
+func BenchmarkAcceptBatching(b *testing.B) {
+	for _, size := range []int{1, acceptBatchSize} {
+		b.Run("batch="+strconv.Itoa(size), func(b *testing.B) {
+			servers := 3
+			inflight := 100
+			paxosConfig := DefaultConfig()
+			paxosConfig.AcceptBatchSize = size
+			cfg := makeConfigWith(b, servers, false, false, paxosConfig)
+			defer cfg.cleanup()
+
+			cfg.one(rand.Int(), servers, true)
+			leader := cfg.checkOneLeader()
+			rpcs0 := cfg.rpcTotal()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				last := -1
+				for j := 0; j < inflight; j++ {
+					last, _, _ = cfg.paxos[leader].Proposal(rand.Int())
+				}
+				cfg.wait(last, servers, -1)
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(cfg.rpcTotal()-rpcs0)/float64(b.N*inflight), "rpcs/cmd")
+		})
+	}
 }
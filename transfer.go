@@ -0,0 +1,104 @@
+package omnipaxos
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Leadership transfer. The leader stops accepting proposals, waits until
+// its log is decided, and asks the target to take over. Once the target
+// holds the whole log it raises its ballot above the leader's, as BLE
+// does when it starts an election, and the next rounds elect it. The old
+// leader steps down when it learns of the new one.
+
+// transferTimeout bounds a transfer, after which the leader accepts
+// proposals again
+const transferTimeout = 2 * time.Second
+
+type TakeLeadershipRequest struct {
+	Me     int
+	N      BallotNumber
+	LogIdx int // the leader's log, all decided
+}
+
+// a TakeLeadership request waiting for our log to catch up
+type takeover struct {
+	n      BallotNumber
+	logIdx int
+}
+
+// TransferLeadership hands leadership to target, and returns true once
+// BLE has elected it.
+func (op *OmniPaxos) TransferLeadership(target int) bool {
+	op.mu.Lock()
+	if op.role != LEADER || op.phase != ACCEPT || target == op.me || target < 0 || target >= op.npeers {
+		op.mu.Unlock()
+		return false
+	}
+	op.transferTarget = target
+	op.flushAccepts()
+	n := op.currentRnd
+	logIdx := op.logLen()
+	op.mu.Unlock()
+
+	defer func() {
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		op.transferTarget = -1
+	}()
+
+	deadline := time.Now().Add(transferTimeout)
+	// nothing we proposed is left for the target to decide
+	if _, ok := op.waitDecided(n, logIdx); !ok {
+		return false
+	}
+	op.mu.Lock()
+	op.send(target, &TakeLeadershipRequest{op.me, n, logIdx})
+	op.mu.Unlock()
+
+	for time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		op.mu.Lock()
+		elected := op.L.Pid == target && op.L.Compare(n) > 0
+		op.mu.Unlock()
+		if elected {
+			return true
+		}
+	}
+	log.Info().Msgf("TransferLeadership(%v): timed out", target)
+	return false
+}
+
+func (op *OmniPaxos) TakeLeadership(args *TakeLeadershipRequest, res *DummyReply) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if op.promisedRnd != args.N || op.role != FOLLOWER {
+		return
+	}
+	op.takeover = takeover{args.N, args.LogIdx}
+	op.checkTakeover()
+}
+
+// checkTakeover raises our ballot above the leader's once we have caught
+// up with a leader that asked us to take over. Must hold op.mu.
+func (op *OmniPaxos) checkTakeover() {
+	if op.takeover.logIdx < 0 {
+		return
+	}
+	if op.promisedRnd != op.takeover.n || op.role != FOLLOWER {
+		// someone else took over first
+		op.takeover = takeover{logIdx: -1}
+		return
+	}
+	if op.phase != ACCEPT || op.receivedLen() < op.takeover.logIdx {
+		return
+	}
+	log.Info().Msgf("Server %v taking over from %v", op.me, op.takeover.n)
+	op.B = BallotNumber{max(op.L.Value, op.takeover.n.Value) + 1, op.B.Priority, op.me}
+	op.bleStats.BallotIncrements++
+	op.qc = true
+	op.persist()
+	op.takeover = takeover{logIdx: -1}
+}
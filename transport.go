@@ -0,0 +1,99 @@
+package omnipaxos
+
+import (
+	"omnipaxos/labrpc"
+)
+
+// Transport carries messages between the servers of a configuration.
+// Peers are numbered 0 to Peers()-1, as in Make, and a server never
+// sends to itself. A send method returns false if the message could not
+// be delivered; one that carries a reply returns false unless the reply
+// came back. The one-way messages are only ever sent to a peer one at a
+// time (see outbox.go), so an implementation can keep them in order by
+// delivering each before returning.
+type Transport interface {
+	Peers() int
+
+	Prepare(peer int, args *PrepareRequest) bool
+	Promise(peer int, args *PromiseFromFollowerRequest) bool
+	AcceptSync(peer int, args *AcceptSyncFromLeaderRequest) bool
+	SyncChunk(peer int, args *SyncChunkFromLeaderRequest) bool
+	Accept(peer int, args *AcceptFromLeaderRequest) bool
+	Accepted(peer int, args *AcceptedFromFollowerRequest) bool
+	Decide(peer int, args *DecideFromLeaderRequest) bool
+	PrepareRecoveringFollower(peer int, args *PrepareRecoveringFollowerRequest) bool
+	TakeLeadership(peer int, args *TakeLeadershipRequest) bool
+
+	HB(peer int, args *HBRequest, reply *HBReply) bool
+	PreVote(peer int, args *PreVoteRequest, reply *PreVoteReply) bool
+	ConfirmLeader(peer int, args *ConfirmLeaderRequest, reply *ConfirmLeaderReply) bool
+	ForwardProposal(peer int, args *ForwardProposalRequest, reply *ForwardProposalReply) bool
+}
+
+// LabrpcTransport sends messages as labrpc calls to the OmniPaxos
+// service at each of ends, which is served by the OmniPaxos handlers.
+func LabrpcTransport(ends []*labrpc.ClientEnd) Transport {
+	return labrpcTransport(ends)
+}
+
+type labrpcTransport []*labrpc.ClientEnd
+
+func (t labrpcTransport) call(peer int, method string, args any, reply any) bool {
+	return t[peer].Call("OmniPaxos."+method, args, reply)
+}
+
+func (t labrpcTransport) Peers() int {
+	return len(t)
+}
+
+func (t labrpcTransport) Prepare(peer int, args *PrepareRequest) bool {
+	return t.call(peer, "RecievePrepare", args, &DummyReply{})
+}
+
+func (t labrpcTransport) Promise(peer int, args *PromiseFromFollowerRequest) bool {
+	return t.call(peer, "PromiseFromFollower", args, &DummyReply{})
+}
+
+func (t labrpcTransport) AcceptSync(peer int, args *AcceptSyncFromLeaderRequest) bool {
+	return t.call(peer, "AcceptSyncFromLeader", args, &DummyReply{})
+}
+
+func (t labrpcTransport) SyncChunk(peer int, args *SyncChunkFromLeaderRequest) bool {
+	return t.call(peer, "SyncChunkFromLeader", args, &DummyReply{})
+}
+
+func (t labrpcTransport) Accept(peer int, args *AcceptFromLeaderRequest) bool {
+	return t.call(peer, "AcceptFromLeader", args, &DummyReply{})
+}
+
+func (t labrpcTransport) Accepted(peer int, args *AcceptedFromFollowerRequest) bool {
+	return t.call(peer, "AcceptedFromFollower", args, &DummyReply{})
+}
+
+func (t labrpcTransport) Decide(peer int, args *DecideFromLeaderRequest) bool {
+	return t.call(peer, "DecideFromLeader", args, &DummyReply{})
+}
+
+func (t labrpcTransport) PrepareRecoveringFollower(peer int, args *PrepareRecoveringFollowerRequest) bool {
+	return t.call(peer, "PrepareRecoveringFollower", args, &DummyReply{})
+}
+
+func (t labrpcTransport) TakeLeadership(peer int, args *TakeLeadershipRequest) bool {
+	return t.call(peer, "TakeLeadership", args, &DummyReply{})
+}
+
+func (t labrpcTransport) HB(peer int, args *HBRequest, reply *HBReply) bool {
+	return t.call(peer, "ReceiveHBRequest", args, reply)
+}
+
+func (t labrpcTransport) PreVote(peer int, args *PreVoteRequest, reply *PreVoteReply) bool {
+	return t.call(peer, "PreVote", args, reply)
+}
+
+func (t labrpcTransport) ConfirmLeader(peer int, args *ConfirmLeaderRequest, reply *ConfirmLeaderReply) bool {
+	return t.call(peer, "ConfirmLeader", args, reply)
+}
+
+func (t labrpcTransport) ForwardProposal(peer int, args *ForwardProposalRequest, reply *ForwardProposalReply) bool {
+	return t.call(peer, "ForwardProposal", args, reply)
+}